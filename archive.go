@@ -0,0 +1,125 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// archiveURL returns the HTTPS tarball URL of a GitHub or GitLab repository at ref, or at its default branch
+// when ref is empty, used by -g when git is not installed. Both https:// and git@host:owner/repo URLs are recognized.
+func archiveURL(repoURL string, ref string) (string, bool) {
+	var host, repoPath string
+	if rest, ok := strings.CutPrefix(repoURL, "git@"); ok {
+		host, repoPath, ok = strings.Cut(rest, ":")
+		if !ok {
+			return "", false
+		}
+	} else {
+		u, err := url.Parse(repoURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+			return "", false
+		}
+		host, repoPath = u.Host, u.Path
+	}
+	repoPath = strings.TrimSuffix(strings.Trim(repoPath, "/"), ".git")
+
+	switch host {
+	case "github.com":
+		parts := strings.Split(repoPath, "/")
+		if len(parts) != 2 {
+			return "", false
+		}
+		if ref == "" {
+			ref = "HEAD"
+		}
+		return "https://codeload.github.com/" + repoPath + "/tar.gz/" + url.PathEscape(ref), true
+	case "gitlab.com":
+		// GitLab projects can be nested in groups, so the archive is requested by full project path
+		if !strings.Contains(repoPath, "/") {
+			return "", false
+		}
+		archive := "https://gitlab.com/api/v4/projects/" + url.PathEscape(repoPath) + "/repository/archive.tar.gz"
+		if ref != "" {
+			archive += "?sha=" + url.QueryEscape(ref)
+		}
+		return archive, true
+	}
+	return "", false
+}
+
+// downloadArchive fetches a gzipped tarball and extracts it into dir, dropping the single top-level
+// directory these archives wrap the repository in. Only regular files and directories are extracted.
+func downloadArchive(ctx context.Context, archive string, dir string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, archive, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("downloading %s: %s", archive, resp.Status)
+	}
+
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", archive, err)
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", archive, err)
+		}
+
+		_, name, _ := strings.Cut(path.Clean(header.Name), "/")
+		if name == "" || name == ".." || strings.HasPrefix(name, "../") || path.IsAbs(name) {
+			continue
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0o755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+				return err
+			}
+			if err := writeArchiveFile(target, header.FileInfo().Mode().Perm(), tr); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// writeArchiveFile writes one extracted file with its archived permission bits.
+func writeArchiveFile(target string, mode os.FileMode, r io.Reader) error {
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"golang.design/x/clipboard"
+)
+
+// clipboardRetryDelay is the backoff between clipboard attempts, multiplied by the attempt number.
+const clipboardRetryDelay = 200 * time.Millisecond
+
+// largeClipboardContent is the size above which terminals and the clipboard library become unreliable,
+// so external tools are preferred and the library copy is verified.
+const largeClipboardContent = 1 << 20
+
+// defaultOSC52Terms lists $TERM / $TERM_PROGRAM fragments of terminals known to support OSC 52.
+var defaultOSC52Terms = []string{"kitty", "xterm", "wezterm", "alacritty", "foot", "ghostty", "iterm"}
+
+// supportsOSC52 reports whether the current terminal is expected to handle OSC 52 clipboard sequences.
+// Additional terminals can be declared in FCOPY_OSC52_TERMS as a comma-separated list of
+// substrings or glob patterns (e.g. "st-256color,*-direct").
+func supportsOSC52() bool {
+	if os.Getenv("TMUX") != "" {
+		return true
+	}
+
+	terms := defaultOSC52Terms
+	if extra := os.Getenv("FCOPY_OSC52_TERMS"); extra != "" {
+		terms = append(terms[:len(terms):len(terms)], strings.Split(extra, ",")...)
+	}
+
+	candidates := []string{
+		strings.ToLower(os.Getenv("TERM")),
+		strings.ToLower(os.Getenv("TERM_PROGRAM")),
+	}
+	for _, pattern := range terms {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "" {
+			continue
+		}
+		for _, candidate := range candidates {
+			if candidate == "" {
+				continue
+			}
+			if strings.ContainsAny(pattern, "*?[") {
+				if matched, _ := filepath.Match(pattern, candidate); matched {
+					return true
+				}
+			} else if strings.Contains(candidate, pattern) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// clipboardTool is an external command taking the clipboard content on stdin.
+type clipboardTool struct {
+	name string // shown in messages, e.g. "xclip -selection clipboard"
+	args []string
+}
+
+// clipboardTools returns the external clipboard commands to try on goos, in order.
+func clipboardTools(goos string) []clipboardTool {
+	switch goos {
+	case "windows":
+		// clip.exe reads stdin in the console code page, which mangles UTF-8, so PowerShell is tried first
+		return []clipboardTool{
+			{name: "powershell Set-Clipboard", args: []string{"powershell", "-NoProfile", "-Command",
+				"[Console]::InputEncoding = [Text.Encoding]::UTF8; Set-Clipboard -Value ([Console]::In.ReadToEnd())"}},
+			{name: "clip", args: []string{"clip"}},
+		}
+	case "darwin":
+		// pbcopy is native; the X11 tools only help with XQuartz and are kept as a fallback
+		return []clipboardTool{
+			{name: "pbcopy", args: []string{"pbcopy"}},
+			{name: "xclip -selection clipboard", args: []string{"xclip", "-selection", "clipboard"}},
+			{name: "xsel --clipboard", args: []string{"xsel", "--clipboard"}},
+		}
+	default:
+		return []clipboardTool{
+			{name: "wl-copy", args: []string{"wl-copy"}},
+			{name: "xclip -selection clipboard", args: []string{"xclip", "-selection", "clipboard"}},
+			{name: "xsel --clipboard", args: []string{"xsel", "--clipboard"}},
+		}
+	}
+}
+
+// copyToClipboard handles the logic of copying text to the system clipboard.
+// It returns the name of the backend that took the content, or "" when there was nothing to copy.
+// With retries > 0, failed copies are re-attempted with a short backoff, the library copy is verified
+// by reading it back, and the unverifiable OSC 52 sequence is emitted a second time.
+func copyToClipboard(content string, useTermAware bool, retries int) string {
+	if strings.TrimSpace(content) == "" {
+		fmt.Fprintln(os.Stderr, "No content to copy to clipboard.")
+		return ""
+	}
+
+	if useTermAware {
+		if supportsOSC52() {
+			if len(content) > largeClipboardContent {
+				fmt.Fprintf(os.Stderr, "Warning: %s of content may exceed the terminal's OSC 52 limit and be truncated; consider -o or -s.\n", formatSize(len(content)))
+			}
+			fmt.Fprintln(os.Stderr, "Attempting clipboard copy via OSC 52 escape code...")
+			encodedContent := base64.StdEncoding.EncodeToString([]byte(content))
+			emissions := 1
+			if retries > 0 {
+				emissions = 2
+			}
+			for i := 0; i < emissions; i++ {
+				if i > 0 {
+					time.Sleep(clipboardRetryDelay)
+				}
+				if os.Getenv("TMUX") != "" {
+					fmt.Printf("\x1bPtmux;\x1b\x1b]52;c;%s\x07\x1b\\", encodedContent)
+				} else {
+					fmt.Printf("\x1b]52;c;%s\x07", encodedContent)
+				}
+			}
+			fmt.Fprintln(os.Stderr, "Content sent to terminal for clipboard (OSC 52).")
+			return "osc52"
+		}
+	}
+
+	if os.Getenv("KITTY_WINDOW_ID") != "" {
+		kittyPath, err := exec.LookPath("kitty")
+		if err == nil {
+			fmt.Fprintln(os.Stderr, "Attempting clipboard copy via `kitty +kitten clipboard`...")
+			if err := runClipboardTool("kitty +kitten clipboard", kittyPath, []string{"+kitten", "clipboard"}, content, retries); err == nil {
+				fmt.Fprintln(os.Stderr, "Content copied to clipboard via `kitty +kitten clipboard`.")
+				return "kitty"
+			}
+		}
+	}
+
+	for _, tool := range clipboardTools(runtime.GOOS) {
+		path, err := exec.LookPath(tool.args[0])
+		if err != nil {
+			continue
+		}
+
+		fmt.Fprintf(os.Stderr, "Attempting clipboard copy via `%s`...\n", tool.name)
+		if err := runClipboardTool(tool.name, path, tool.args[1:], content, retries); err == nil {
+			fmt.Fprintf(os.Stderr, "Content copied to clipboard via `%s`.\n", tool.name)
+			return tool.args[0]
+		} else {
+			fmt.Fprintf(os.Stderr, "Failed to copy with `%s`: %v\n", tool.name, err)
+		}
+	}
+
+	fmt.Fprintln(os.Stderr, "Falling back to default clipboard library (may not work over SSH)...")
+	large := len(content) > largeClipboardContent
+	if large {
+		fmt.Fprintf(os.Stderr, "Warning: %s is large for the clipboard library, which can fail or truncate silently; install wl-clipboard, xclip or xsel, or use -o/-s.\n", formatSize(len(content)))
+	}
+	if err := clipboard.Init(); err != nil {
+		fatalf("Failed to initialize clipboard library: %v\nPlease install xclip/xsel or wl-clipboard, or use -t.", err)
+	}
+	// Large payloads are always read back, so a truncated copy is reported instead of going unnoticed.
+	if retries == 0 && !large {
+		clipboard.Write(clipboard.FmtText, []byte(content))
+		fmt.Fprintln(os.Stderr, "Content copied to clipboard!")
+		return "clipboard-library"
+	}
+
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			fmt.Fprintf(os.Stderr, "Clipboard content did not match, retrying (attempt %d of %d)...\n", attempt+1, retries+1)
+			time.Sleep(time.Duration(attempt) * clipboardRetryDelay)
+		}
+		clipboard.Write(clipboard.FmtText, []byte(content))
+		if string(clipboard.Read(clipboard.FmtText)) == content {
+			fmt.Fprintln(os.Stderr, "Content copied to clipboard (verified)!")
+			return "clipboard-library"
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Warning: could not verify the clipboard content after %d attempts.\n", retries+1)
+	return "clipboard-library"
+}
+
+// formatSize renders a byte count with a binary unit suffix, e.g. "1.5 MiB".
+func formatSize(size int) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := unit, 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// runClipboardTool pipes content into a clipboard command, re-running it up to retries more times on failure.
+func runClipboardTool(name string, path string, args []string, content string, retries int) error {
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			fmt.Fprintf(os.Stderr, "Retrying `%s` (attempt %d of %d)...\n", name, attempt+1, retries+1)
+			time.Sleep(time.Duration(attempt) * clipboardRetryDelay)
+		}
+		cmd := exec.Command(path, args...)
+		cmd.Stdin = strings.NewReader(content)
+		cmd.Stderr = os.Stderr
+		if err = cmd.Run(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,146 @@
+package main
+
+import "strings"
+
+// commentSyntax lists the line comment prefixes and the block comment delimiters of a language.
+type commentSyntax struct {
+	line   []string
+	blocks [][2]string
+}
+
+var (
+	cStyleComments = commentSyntax{line: []string{"//"}, blocks: [][2]string{{"/*", "*/"}}}
+	hashComments   = commentSyntax{line: []string{"#"}}
+	markupComments = commentSyntax{blocks: [][2]string{{"<!--", "-->"}}}
+)
+
+// commentSyntaxes maps the language hints of getLanguageHint to their comment syntax, for -prune-comments-only-files.
+// Python docstrings count as comments, so a module holding only a docstring is pruned too.
+var commentSyntaxes = map[string]commentSyntax{
+	"c":          cStyleComments,
+	"cpp":        cStyleComments,
+	"csharp":     cStyleComments,
+	"go":         cStyleComments,
+	"java":       cStyleComments,
+	"javascript": cStyleComments,
+	"kotlin":     cStyleComments,
+	"rust":       cStyleComments,
+	"swift":      cStyleComments,
+	"typescript": cStyleComments,
+	"css":        {blocks: [][2]string{{"/*", "*/"}}},
+	"php":        {line: []string{"//", "#"}, blocks: [][2]string{{"/*", "*/"}}},
+	"hcl":        {line: []string{"#", "//"}, blocks: [][2]string{{"/*", "*/"}}},
+	"bash":       hashComments,
+	"dockerfile": hashComments,
+	"toml":       hashComments,
+	"yaml":       hashComments,
+	"ruby":       {line: []string{"#"}, blocks: [][2]string{{"=begin", "=end"}}},
+	"python":     {line: []string{"#"}, blocks: [][2]string{{`"""`, `"""`}, {"'''", "'''"}}},
+	"sql":        {line: []string{"--"}, blocks: [][2]string{{"/*", "*/"}}},
+	"html":       markupComments,
+	"xml":        markupComments,
+}
+
+// onlyComments reports whether content holds at least one comment and nothing else but whitespace,
+// like a file reduced to a license header. It reports false for languages without a known comment syntax.
+func onlyComments(lang string, content []byte) bool {
+	syntax, ok := commentSyntaxes[lang]
+	if !ok {
+		return false
+	}
+
+	rest := string(content)
+	found := false
+	for {
+		rest = strings.TrimLeft(rest, " \t\r\n\f\uFEFF")
+		if rest == "" {
+			return found
+		}
+		skipped := false
+		for _, prefix := range syntax.line {
+			if strings.HasPrefix(rest, prefix) {
+				_, rest, _ = strings.Cut(rest, "\n")
+				skipped = true
+				break
+			}
+		}
+		for _, block := range syntax.blocks {
+			if skipped {
+				break
+			}
+			if strings.HasPrefix(rest, block[0]) {
+				end := strings.Index(rest[len(block[0]):], block[1])
+				if end < 0 {
+					// An unterminated comment runs to the end of the file
+					return true
+				}
+				rest = rest[len(block[0])+end+len(block[1]):]
+				skipped = true
+			}
+		}
+		if !skipped {
+			return false
+		}
+		found = true
+	}
+}
+
+// commentLeaders and commentTrailers are stripped from a line before comparing it to a region marker,
+// so markers work in any language: "// fcopy-start", "# fcopy-start", "<!-- fcopy-start -->", ...
+var (
+	commentLeaders  = []string{"//", "/*", "#", "--", "<!--", ";", "%", "*"}
+	commentTrailers = []string{"*/", "-->"}
+)
+
+// isMarkerLine reports whether line is a comment holding only marker.
+func isMarkerLine(line string, marker string) bool {
+	line = strings.TrimSpace(line)
+	stripped := false
+	for _, leader := range commentLeaders {
+		if rest, ok := strings.CutPrefix(line, leader); ok {
+			line, stripped = rest, true
+			break
+		}
+	}
+	if !stripped {
+		return false
+	}
+	line = strings.TrimSpace(line)
+	for _, trailer := range commentTrailers {
+		line = strings.TrimSpace(strings.TrimSuffix(line, trailer))
+	}
+	return line == marker
+}
+
+// extractRegions returns the lines between start and end marker comments, the markers excluded, one string
+// per region. A start marker without an end runs to the end of the file.
+func extractRegions(content []byte, start string, end string) []string {
+	var regions []string
+	var current []string
+	inRegion := false
+	for _, line := range strings.SplitAfter(string(content), "\n") {
+		switch {
+		case !inRegion && isMarkerLine(line, start):
+			inRegion = true
+		case inRegion && isMarkerLine(line, end):
+			regions = append(regions, strings.Join(current, ""))
+			current, inRegion = nil, false
+		case inRegion:
+			current = append(current, line)
+		}
+	}
+	if inRegion {
+		regions = append(regions, strings.Join(current, ""))
+	}
+	return regions
+}
+
+// joinRegions joins the regions of a file with a "..." line.
+func joinRegions(regions []string) []byte {
+	for i, region := range regions {
+		if region != "" && !strings.HasSuffix(region, "\n") {
+			regions[i] = region + "\n"
+		}
+	}
+	return []byte(strings.Join(regions, "...\n"))
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// configFileName is the project config file, looked up in the current directory.
+// The user config file is "fcopy/config" in the user config directory ($XDG_CONFIG_HOME on Linux).
+const configFileName = ".fcopyrc"
+
+// configSetting is a "flag = value" line of a config file.
+type configSetting struct {
+	key   string
+	value string
+	line  int
+}
+
+// configFile is a parsed config file: settings grouped by [section], "" holding those before the first section.
+type configFile struct {
+	path     string
+	sections map[string][]configSetting
+}
+
+// configPaths returns the config files to consult, the project one first.
+func configPaths() []string {
+	paths := []string{configFileName}
+	if dir, err := os.UserConfigDir(); err == nil {
+		paths = append(paths, filepath.Join(dir, "fcopy", "config"))
+	}
+	return paths
+}
+
+// readConfig parses a config file. Keys are flag names, with or without the leading dash; a key may be
+// repeated for repeatable flags. Values may be double-quoted to keep surrounding spaces or use escapes like \n.
+func readConfig(path string) (*configFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	config := &configFile{path: path, sections: make(map[string][]configSetting)}
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected 'flag = value'", path, lineNumber)
+		}
+		key = strings.TrimLeft(strings.TrimSpace(key), "-")
+		value = strings.TrimSpace(value)
+		if strings.HasPrefix(value, `"`) {
+			if value, err = strconv.Unquote(value); err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid quoted value: %v", path, lineNumber, err)
+			}
+		}
+		config.sections[section] = append(config.sections[section], configSetting{key: key, value: value, line: lineNumber})
+	}
+	return config, scanner.Err()
+}
+
+// applyConfigSettings sets flags from config settings, skipping the flags given on the command line so they take precedence.
+func applyConfigSettings(path string, settings []configSetting, explicit map[string]bool) error {
+	for _, setting := range settings {
+		if setting.key == "profile" {
+			return fmt.Errorf("%s:%d: a config file cannot select a profile", path, setting.line)
+		}
+		if flag.Lookup(setting.key) == nil {
+			return fmt.Errorf("%s:%d: unknown flag '%s'", path, setting.line, setting.key)
+		}
+		if explicit[setting.key] {
+			continue
+		}
+		if err := flag.Set(setting.key, setting.value); err != nil {
+			return fmt.Errorf("%s:%d: invalid value for -%s: %v", path, setting.line, setting.key, err)
+		}
+	}
+	return nil
+}
+
+// applyConfig sets flags from the config files: first the settings before any section, the defaults,
+// of the user config then of the project config, then, when profile is set, the [profile] section of
+// the first config file defining it. The precedence is thus command-line flags, then the profile,
+// then the project defaults, then the user defaults, then the built-in defaults.
+func applyConfig(profile string) error {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	var configs []*configFile
+	for _, path := range configPaths() {
+		config, err := readConfig(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		configs = append(configs, config)
+	}
+
+	// The project config comes first in configs, and its defaults are set last to override the user's
+	for i := len(configs) - 1; i >= 0; i-- {
+		if err := applyConfigSettings(configs[i].path, configs[i].sections[""], explicit); err != nil {
+			return err
+		}
+	}
+
+	if profile == "" {
+		return nil
+	}
+	for _, config := range configs {
+		if settings, ok := config.sections[profile]; ok {
+			return applyConfigSettings(config.path, settings, explicit)
+		}
+	}
+	return fmt.Errorf("profile '%s' not found in %s", profile, strings.Join(configPaths(), " or "))
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// defaultTabWidth is used to expand tabs when no .editorconfig sets tab_width or indent_size.
+const defaultTabWidth = 8
+
+// editorConfigSection is a [glob] section of an .editorconfig file with its lowercased properties.
+type editorConfigSection struct {
+	glob       string
+	properties map[string]string
+}
+
+// editorConfigFile is a parsed .editorconfig file.
+type editorConfigFile struct {
+	root     bool
+	sections []editorConfigSection
+}
+
+// readEditorConfig parses the .editorconfig file of dir, if any.
+func readEditorConfig(dir string) (*editorConfigFile, bool) {
+	file, err := os.Open(filepath.Join(dir, ".editorconfig"))
+	if err != nil {
+		return nil, false
+	}
+	defer file.Close()
+
+	config := &editorConfigFile{}
+	var current *editorConfigSection
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			config.sections = append(config.sections, editorConfigSection{
+				glob:       line[1 : len(line)-1],
+				properties: make(map[string]string),
+			})
+			current = &config.sections[len(config.sections)-1]
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.ToLower(strings.TrimSpace(value))
+		if current == nil {
+			// Only "root" is allowed before the first section
+			config.root = key == "root" && value == "true"
+			continue
+		}
+		current.properties[key] = value
+	}
+	return config, true
+}
+
+// editorConfigMatch reports whether an .editorconfig section glob applies to relPath, the slash separated path
+// of a file relative to the directory of the .editorconfig. Globs without a slash match the file name anywhere;
+// "{a,b}" alternatives are expanded and "**" is treated like "*".
+func editorConfigMatch(glob string, relPath string) bool {
+	for _, pattern := range expandBraces(glob) {
+		pattern = strings.ReplaceAll(pattern, "**", "*")
+		target := relPath
+		if !strings.Contains(pattern, "/") {
+			target = filepath.Base(relPath)
+		}
+		if matched, _ := filepath.Match(strings.TrimPrefix(pattern, "/"), target); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// expandBraces expands the first "{a,b}" group of a glob, recursively, into every alternative.
+func expandBraces(glob string) []string {
+	start := strings.IndexByte(glob, '{')
+	end := strings.IndexByte(glob, '}')
+	if start < 0 || end < start {
+		return []string{glob}
+	}
+	var expanded []string
+	for _, alternative := range strings.Split(glob[start+1:end], ",") {
+		expanded = append(expanded, expandBraces(glob[:start]+alternative+glob[end+1:])...)
+	}
+	return expanded
+}
+
+// tabWidth returns the tab width the .editorconfig files above a file set for it: tab_width, else a numeric
+// indent_size, else defaultTabWidth. Files nearer to the file take precedence, and the search stops at
+// an .editorconfig declaring root = true. Parsed files are cached per directory.
+func (p *processor) tabWidth(absFilePath string) int {
+	if absFilePath == "" {
+		return defaultTabWidth
+	}
+
+	// Collect the configs from the nearest directory up to the root
+	var dirs []string
+	var configs []*editorConfigFile
+	for dir := filepath.Dir(absFilePath); ; {
+		config, ok := p.editorConfigs[dir]
+		if !ok {
+			config, _ = readEditorConfig(dir)
+			p.editorConfigs[dir] = config
+		}
+		if config != nil {
+			dirs = append(dirs, dir)
+			configs = append(configs, config)
+			if config.root {
+				break
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+
+	// Apply them from the farthest to the nearest, so the nearest wins
+	properties := make(map[string]string)
+	for i := len(configs) - 1; i >= 0; i-- {
+		relPath, err := filepath.Rel(dirs[i], absFilePath)
+		if err != nil {
+			continue
+		}
+		for _, section := range configs[i].sections {
+			if editorConfigMatch(section.glob, filepath.ToSlash(relPath)) {
+				for key, value := range section.properties {
+					properties[key] = value
+				}
+			}
+		}
+	}
+
+	for _, key := range []string{"tab_width", "indent_size"} {
+		if width, err := strconv.Atoi(properties[key]); err == nil && width > 0 {
+			return width
+		}
+	}
+	return defaultTabWidth
+}
+
+// expandTabs replaces tabs with spaces up to the next multiple of width, column by column on every line.
+func expandTabs(content []byte, width int) []byte {
+	if !bytes.ContainsRune(content, '\t') {
+		return content
+	}
+	var out bytes.Buffer
+	out.Grow(len(content))
+	column := 0
+	for _, r := range string(content) {
+		switch r {
+		case '\t':
+			spaces := width - column%width
+			out.WriteString(strings.Repeat(" ", spaces))
+			column += spaces
+		case '\n':
+			out.WriteRune(r)
+			column = 0
+		default:
+			out.WriteRune(r)
+			column++
+		}
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,70 @@
+package main
+
+import "strings"
+
+// formatter renders the collected blocks in an output format: each block on its own, then the rendered
+// blocks assembled into the files section. JSON is rendered separately by renderJSON, as a single document.
+type formatter interface {
+	block(block outputBlock) string
+	join(rendered []string) string
+}
+
+// markdownFormatter renders blocks as fenced code blocks separated by the -delimiter.
+type markdownFormatter struct {
+	delimiter string
+}
+
+func (f markdownFormatter) block(block outputBlock) string {
+	return block.render()
+}
+
+func (f markdownFormatter) join(rendered []string) string {
+	separator := f.delimiter
+	if !strings.HasSuffix(separator, "\n") {
+		separator += "\n"
+	}
+	return strings.Join(rendered, separator)
+}
+
+// xmlFormatter renders file blocks as <file path="..."> elements inside a <documents> root, which stays
+// unambiguous when the files themselves contain code fences. Generated blocks, such as command output,
+// are <output title="..."> elements. Headings are kept as escaped text before their block.
+type xmlFormatter struct{}
+
+var (
+	xmlTextEscaper      = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	xmlAttributeEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+)
+
+func (f xmlFormatter) block(block outputBlock) string {
+	var builder strings.Builder
+	if block.heading != "" {
+		builder.WriteString(xmlTextEscaper.Replace(strings.TrimRight(block.heading, "\n")) + "\n")
+	}
+
+	element, nameAttribute := "output", "title"
+	if block.isFile {
+		element, nameAttribute = "file", "path"
+	}
+	builder.WriteString("<" + element + " " + nameAttribute + `="` + xmlAttributeEscaper.Replace(block.title) + `"`)
+	if block.lang != "" {
+		builder.WriteString(` language="` + xmlAttributeEscaper.Replace(block.lang) + `"`)
+	}
+	if len(block.notes) > 0 {
+		builder.WriteString(` notes="` + xmlAttributeEscaper.Replace(strings.Join(block.notes, ", ")) + `"`)
+	}
+	builder.WriteString(">\n")
+	builder.WriteString(xmlTextEscaper.Replace(string(block.content)))
+	if len(block.content) > 0 && block.content[len(block.content)-1] != '\n' {
+		builder.WriteByte('\n')
+	}
+	builder.WriteString("</" + element + ">\n")
+	return builder.String()
+}
+
+func (f xmlFormatter) join(rendered []string) string {
+	if len(rendered) == 0 {
+		return ""
+	}
+	return "<documents>\n" + strings.Join(rendered, "") + "</documents>\n"
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// gitRepoRoot returns the top-level directory of the git repository containing dir.
+func gitRepoRoot(ctx context.Context, dir string) (string, error) {
+	out, err := exec.CommandContext(ctx, "git", "-C", dir, "rev-parse", "--show-toplevel").Output()
+	if err != nil {
+		return "", fmt.Errorf("not inside a git repository: %w", err)
+	}
+	return filepath.FromSlash(strings.TrimSpace(string(out))), nil
+}
+
+// cloneRepository makes a shallow clone of repoURL into dir for -g, streaming git's progress to stderr unless quiet.
+// A non-empty ref, a branch or a tag, is cloned instead of the default branch; git fails when it doesn't exist.
+func cloneRepository(ctx context.Context, repoURL, dir, ref string, quiet, submodules bool) error {
+	fmt.Fprintf(os.Stderr, "Cloning %s into temporary directory...\n", repoURL)
+	cmd := exec.CommandContext(ctx, "git", cloneArgs(repoURL, dir, ref, quiet, submodules)...)
+	// With --quiet git only writes errors to stderr, so it can stay attached
+	cmd.Stderr = os.Stderr
+	if !quiet {
+		cmd.Stdout = os.Stderr
+	}
+	return cmd.Run()
+}
+
+// cloneArgs builds the arguments of the git clone command run by cloneRepository.
+func cloneArgs(repoURL, dir, ref string, quiet, submodules bool) []string {
+	cloneArgs := []string{"clone", "--depth", "1"}
+	if ref != "" {
+		cloneArgs = append(cloneArgs, "--branch", ref)
+	}
+	if quiet {
+		cloneArgs = append(cloneArgs, "--quiet")
+	}
+	if submodules {
+		cloneArgs = append(cloneArgs, "--recurse-submodules", "--shallow-submodules")
+	}
+	// "--" keeps a URL or directory starting with a dash from being read as an option
+	return append(cloneArgs, "--", repoURL, dir)
+}
+
+// gitListFilesAtRev lists the files tracked at rev under relPath (relative to the repo root, slash separated).
+func gitListFilesAtRev(ctx context.Context, repoRoot, rev, relPath string) ([]string, error) {
+	args := []string{"-C", repoRoot, "ls-tree", "-r", "-z", "--name-only", "--full-tree", rev}
+	if relPath != "" && relPath != "." {
+		args = append(args, "--", relPath)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git ls-tree %s: %v: %s", rev, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var files []string
+	for _, name := range strings.Split(string(out), "\x00") {
+		if name != "" {
+			files = append(files, name)
+		}
+	}
+	return files, nil
+}
+
+// gitShowFile returns the content of relPath (relative to the repo root) at rev.
+func gitShowFile(ctx context.Context, repoRoot, rev, relPath string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", "-C", repoRoot, "show", rev+":"+relPath)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git show %s:%s: %v: %s", rev, relPath, err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// gitCommitsInRange lists the commits of rangeSpec touching relPath, oldest first.
+func gitCommitsInRange(ctx context.Context, repoRoot, rangeSpec, relPath string) ([]string, error) {
+	args := []string{"-C", repoRoot, "rev-list", "--reverse", rangeSpec}
+	if relPath != "" && relPath != "." {
+		args = append(args, "--", relPath)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git rev-list %s: %v: %s", rangeSpec, err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// gitRun runs git in repoRoot and returns its stdout, folding stderr into the error.
+func gitRun(ctx context.Context, repoRoot string, args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", repoRoot}, args...)...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// gitLastCommitDate returns the committer date, in strict ISO 8601, of the last commit touching a file,
+// for -git-mtime. A single git log per repository collects the dates of every file; files outside
+// of a repository, or never committed, have none.
+func (p *processor) gitLastCommitDate(absFilePath string) (string, bool) {
+	dir := filepath.Dir(absFilePath)
+	root, ok := p.gitRoots[dir]
+	if !ok {
+		root, _ = gitRepoRoot(p.ctx, dir)
+		p.gitRoots[dir] = root
+	}
+	if root == "" {
+		return "", false
+	}
+
+	dates, ok := p.gitDates[root]
+	if !ok {
+		dates = make(map[string]string)
+		p.gitDates[root] = dates
+		out, err := gitRun(p.ctx, root, "-c", "core.quotePath=false", "log", "--format=format:%x01%cI", "--name-only")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: cannot read commit dates in %s: %v\n", root, err)
+		}
+		// Commits are listed newest first, so the first date seen for a path is its last change
+		date := ""
+		for _, line := range strings.Split(out, "\n") {
+			if rest, ok := strings.CutPrefix(line, "\x01"); ok {
+				date = rest
+			} else if line != "" && dates[line] == "" {
+				dates[line] = date
+			}
+		}
+	}
+
+	relPath, err := filepath.Rel(root, absFilePath)
+	if err != nil {
+		return "", false
+	}
+	date, ok := dates[filepath.ToSlash(relPath)]
+	return date, ok
+}
+
+// gitBlame returns the content of a file with every line prefixed by the short hash and author
+// of the commit that last changed it, parsed from git blame --porcelain.
+func gitBlame(ctx context.Context, absFilePath string) ([]byte, error) {
+	out, err := gitRun(ctx, filepath.Dir(absFilePath), "blame", "--porcelain", "--", filepath.Base(absFilePath))
+	if err != nil {
+		return nil, err
+	}
+
+	type blameLine struct{ hash, text string }
+	var lines []blameLine
+	authors := make(map[string]string)
+	authorWidth := 0
+	hash := ""
+	for _, line := range strings.Split(out, "\n") {
+		switch {
+		case strings.HasPrefix(line, "\t"):
+			lines = append(lines, blameLine{hash: hash, text: line[1:]})
+		case strings.HasPrefix(line, "author "):
+			authors[hash] = strings.TrimPrefix(line, "author ")
+			authorWidth = max(authorWidth, len(authors[hash]))
+		default:
+			// Each line group starts with "<hash> <orig line> <final line> [<count>]"
+			if fields := strings.Fields(line); len(fields) >= 3 && len(fields[0]) >= 40 {
+				hash = fields[0]
+			}
+		}
+	}
+
+	var annotated bytes.Buffer
+	for _, line := range lines {
+		prefix := fmt.Sprintf("%s %-*s |", line.hash[:8], authorWidth, authors[line.hash])
+		if line.text != "" {
+			prefix += " " + line.text
+		}
+		annotated.WriteString(prefix + "\n")
+	}
+	return annotated.Bytes(), nil
+}
+
+// gitTargetLocation resolves the repository root of a target and the target's path relative to it.
+func gitTargetLocation(ctx context.Context, t target) (repoRoot string, relPath string, err error) {
+	dir := t.absPath
+	if !t.isDir {
+		dir = filepath.Dir(t.absPath)
+	}
+	repoRoot, err = gitRepoRoot(ctx, dir)
+	if err != nil {
+		return "", "", err
+	}
+
+	// Resolve symlinks on both sides so temp directories like /tmp -> /private/tmp compare equal.
+	realTarget, err := filepath.EvalSymlinks(t.absPath)
+	if err != nil {
+		realTarget = t.absPath
+	}
+	relPath, err = filepath.Rel(repoRoot, realTarget)
+	if err != nil {
+		return "", "", err
+	}
+	return repoRoot, filepath.ToSlash(relPath), nil
+}
+
+// processCommits emits one section per commit in rangeSpec that touches the target:
+// the commit message as a heading followed by its diff, restricted to the target, in a fenced diff block.
+func (p *processor) processCommits(t target, rangeSpec string) {
+	repoRoot, relTarget, err := gitTargetLocation(p.ctx, t)
+	if err != nil {
+		p.reportError("Error: cannot use -commits on %s: %v", t.displayBase, err)
+		return
+	}
+
+	commits, err := gitCommitsInRange(p.ctx, repoRoot, rangeSpec, relTarget)
+	if err != nil {
+		p.reportError("Error listing commits in %s: %v", rangeSpec, err)
+		return
+	}
+	if len(commits) == 0 {
+		fmt.Fprintf(os.Stderr, "No commits in %s touch %s\n", rangeSpec, t.displayBase)
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "Processing %d commit(s) in %s for %s\n", len(commits), rangeSpec, t.displayBase)
+	var pathspec []string
+	if relTarget != "." {
+		pathspec = []string{"--", relTarget}
+	}
+	for _, commit := range commits {
+		if p.ctx.Err() != nil {
+			return
+		}
+
+		meta, err := gitRun(p.ctx, repoRoot, "show", "-s", "--format=%h%x00%an <%ae>%x00%aI%x00%B", commit)
+		if err != nil {
+			p.reportError("Error reading commit %s: %v", commit, err)
+			continue
+		}
+		fields := strings.SplitN(meta, "\x00", 4)
+		if len(fields) < 4 {
+			p.reportError("Error reading commit %s: unexpected git output", commit)
+			continue
+		}
+		shortHash, author, date, message := fields[0], fields[1], fields[2], strings.TrimSpace(fields[3])
+
+		diff, err := gitRun(p.ctx, repoRoot, append([]string{"show", "--format=", "--patch", commit}, pathspec...)...)
+		if err != nil {
+			p.reportError("Error reading diff of commit %s: %v", commit, err)
+			continue
+		}
+
+		subject, body, _ := strings.Cut(message, "\n")
+		heading := fmt.Sprintf("### Commit %s: %s\n\nAuthor: %s  \nDate: %s", shortHash, subject, author, date)
+		if body = strings.TrimSpace(body); body != "" {
+			heading += "\n\n" + body
+		}
+
+		fmt.Fprintf(os.Stderr, "Adding commit: %s %s\n", shortHash, subject)
+		p.blocks = append(p.blocks, outputBlock{
+			heading: heading,
+			lang:    "diff",
+			title:   shortHash,
+			content: []byte(strings.TrimLeft(diff, "\n")),
+		})
+	}
+}
+
+// processDiff emits the uncommitted changes of the target against HEAD in a fenced diff block.
+// Targets outside a git repository and untracked paths fall back to their full content.
+func (p *processor) processDiff(t target, excludePatterns []string) {
+	repoRoot, relTarget, err := gitTargetLocation(p.ctx, t)
+	if err == nil {
+		_, err = gitRun(p.ctx, repoRoot, "ls-files", "--error-unmatch", "--", relTarget)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s is not tracked by git, including its full content instead of a diff\n", t.displayBase)
+		if t.isDir {
+			p.processDirectory(t.absPath, t.displayBase, excludePatterns)
+		} else {
+			p.processFile(t.absPath, t.displayBase)
+		}
+		return
+	}
+
+	diff, err := gitRun(p.ctx, repoRoot, "diff", "HEAD", "--", relTarget)
+	if err != nil {
+		p.reportError("Error reading diff of %s: %v", t.displayBase, err)
+		return
+	}
+	notes := []string{"diff against HEAD"}
+	if diff == "" {
+		notes = append(notes, "no changes")
+	}
+
+	displayPath := filepath.ToSlash(t.displayBase)
+	fmt.Fprintf(os.Stderr, "Adding diff: %s\n", displayPath)
+	if !t.isDir {
+		p.included = append(p.included, displayPath)
+	}
+	p.stats.included++
+	p.stats.includedBytes += len(diff)
+	p.blocks = append(p.blocks, outputBlock{
+		lang:    "diff",
+		title:   displayPath,
+		notes:   notes,
+		content: []byte(diff),
+		isFile:  true,
+	})
+}
+
+// processRevision emits every tracked file under the target as it was at rev, without touching the working tree.
+// Exclude patterns and hidden-path rules are applied the same way as for a directory walk.
+func (p *processor) processRevision(t target, rev string, excludePatterns []string) {
+	repoRoot, relTarget, err := gitTargetLocation(p.ctx, t)
+	if err != nil {
+		p.reportError("Error: cannot use -at-rev on %s: %v", t.displayBase, err)
+		return
+	}
+
+	files, err := gitListFilesAtRev(p.ctx, repoRoot, rev, relTarget)
+	if err != nil {
+		p.reportError("Error listing files at revision %s: %v", rev, err)
+		return
+	}
+	if len(files) == 0 {
+		fmt.Fprintf(os.Stderr, "Skipping %s: it did not exist at revision %s\n", t.displayBase, rev)
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "Processing %s at revision %s\n", t.displayBase, rev)
+	for _, file := range files {
+		if p.ctx.Err() != nil {
+			return
+		}
+
+		displayFilePath := filepath.ToSlash(t.displayBase)
+		if t.isDir {
+			relativePath := file
+			if relTarget != "." {
+				relativePath = strings.TrimPrefix(file, relTarget+"/")
+			}
+			if skip, category, reason := p.revisionPathSkipped(relativePath, excludePatterns); skip {
+				fmt.Fprintf(os.Stderr, "Skipping %s: %s\n", relativePath, reason)
+				p.stats.skip(category, filepath.ToSlash(filepath.Join(t.displayBase, relativePath)))
+				continue
+			}
+			displayFilePath = filepath.ToSlash(filepath.Join(t.displayBase, relativePath))
+		}
+
+		content, err := gitShowFile(p.ctx, repoRoot, rev, file)
+		if err != nil {
+			p.reportError("Error reading %s at revision %s: %v", displayFilePath, rev, err)
+			continue
+		}
+		p.processContent(content, filepath.Join(repoRoot, filepath.FromSlash(file)), displayFilePath)
+	}
+}
+
+// revisionPathSkipped mirrors the directory walk filters for a path listed from git:
+// the path and each of its parent directories are checked against the exclude patterns and for hidden names.
+// It returns the skip category recorded in the run stats and a human readable reason.
+func (p *processor) revisionPathSkipped(relativePath string, excludePatterns []string) (bool, string, string) {
+	parts := strings.Split(relativePath, "/")
+	for i := range parts {
+		partial := strings.Join(parts[:i+1], "/")
+		if excluded, pattern := p.isExcluded(partial, excludePatterns); excluded {
+			return true, skipExcluded, fmt.Sprintf("matches exclude pattern '%s'", pattern)
+		}
+		if hiddenSkipped(partial, p.includeHidden, p.hiddenAllow) {
+			return true, skipHidden, "hidden path"
+		}
+	}
+	if p.skipLocks && lockFiles[strings.ToLower(parts[len(parts)-1])] {
+		return true, skipLockFile, "lock file"
+	}
+	if skip, reason := p.testSkipped(relativePath); skip {
+		return true, reason, reason
+	}
+	if !p.isIncluded(relativePath) {
+		return true, skipNotIncluded, "matches no include pattern"
+	}
+	return false, "", ""
+}
@@ -2,11 +2,14 @@ module github.com/akhenakh/fcopy
 
 go 1.24.2
 
-require golang.design/x/clipboard v0.7.0
+require (
+	github.com/fsnotify/fsnotify v1.9.0
+	golang.design/x/clipboard v0.7.0
+)
 
 require (
 	golang.org/x/exp v0.0.0-20190731235908-ec7cb31e5a56 // indirect
 	golang.org/x/image v0.6.0 // indirect
 	golang.org/x/mobile v0.0.0-20230301163155-e0f57694e12c // indirect
-	golang.org/x/sys v0.5.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
 )
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"html"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// markdownToHTML renders the small subset of markdown fcopy produces (fenced code blocks,
+// headings, bullet lists and paragraphs) to HTML suitable for rich-text clipboard targets.
+func markdownToHTML(markdown string) string {
+	var sb strings.Builder
+	var paragraph, list []string
+	var fence, fenceLang string
+	var code strings.Builder
+	inFence := false
+
+	flushParagraph := func() {
+		if len(paragraph) > 0 {
+			sb.WriteString("<p>" + strings.Join(paragraph, "<br>\n") + "</p>\n")
+			paragraph = nil
+		}
+	}
+	flushList := func() {
+		if len(list) > 0 {
+			sb.WriteString("<ul>\n")
+			for _, item := range list {
+				sb.WriteString("<li>" + item + "</li>\n")
+			}
+			sb.WriteString("</ul>\n")
+			list = nil
+		}
+	}
+
+	for _, line := range strings.Split(markdown, "\n") {
+		trimmed := strings.TrimSpace(line)
+
+		if inFence {
+			if strings.TrimRight(trimmed, "`") == "" && len(trimmed) >= len(fence) {
+				class := ""
+				if fenceLang != "" {
+					class = fmt.Sprintf(` class="language-%s"`, html.EscapeString(fenceLang))
+				}
+				sb.WriteString(fmt.Sprintf("<pre><code%s>%s</code></pre>\n", class, html.EscapeString(code.String())))
+				code.Reset()
+				inFence = false
+				continue
+			}
+			code.WriteString(line + "\n")
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "```") {
+			flushParagraph()
+			flushList()
+			info := strings.TrimLeft(trimmed, "`")
+			fence = trimmed[:len(trimmed)-len(info)]
+			fenceLang = ""
+			title := ""
+			if fields := strings.Fields(info); len(fields) > 0 {
+				fenceLang = fields[0]
+				title = strings.TrimSpace(strings.TrimPrefix(info, fields[0]))
+			}
+			// A single word is a path when it has no language hint in front of it.
+			if title == "" && strings.ContainsAny(fenceLang, "./") {
+				fenceLang, title = "", fenceLang
+			}
+			if title != "" {
+				sb.WriteString("<p><strong><code>" + html.EscapeString(title) + "</code></strong></p>\n")
+			}
+			inFence = true
+			continue
+		}
+
+		switch {
+		case trimmed == "":
+			flushParagraph()
+			flushList()
+		case strings.HasPrefix(trimmed, "#"):
+			flushParagraph()
+			flushList()
+			level := len(trimmed) - len(strings.TrimLeft(trimmed, "#"))
+			if level > 6 {
+				level = 6
+			}
+			text := strings.TrimSpace(strings.TrimLeft(trimmed, "#"))
+			sb.WriteString(fmt.Sprintf("<h%d>%s</h%d>\n", level, html.EscapeString(text), level))
+		case strings.HasPrefix(trimmed, "- ") || strings.HasPrefix(trimmed, "* "):
+			flushParagraph()
+			list = append(list, html.EscapeString(strings.TrimSpace(trimmed[2:])))
+		default:
+			flushList()
+			paragraph = append(paragraph, html.EscapeString(line))
+		}
+	}
+
+	// An unterminated fence still gets its content emitted.
+	if inFence {
+		sb.WriteString("<pre><code>" + html.EscapeString(code.String()) + "</code></pre>\n")
+	}
+	flushParagraph()
+	flushList()
+	return sb.String()
+}
+
+// copyHTMLToClipboard renders markdown to HTML and places it on the clipboard as an HTML flavor
+// using the platform's native tooling. It returns the name of the tool that accepted the content, or "" if none did.
+func copyHTMLToClipboard(markdown string) string {
+	htmlContent := markdownToHTML(markdown)
+
+	type htmlTool struct {
+		name  string
+		args  []string
+		input string
+	}
+	var tools []htmlTool
+	switch runtime.GOOS {
+	case "darwin":
+		// osascript can set an HTML flavor from hex-encoded data.
+		script := fmt.Sprintf("set the clipboard to «data HTML%s»", strings.ToUpper(hex.EncodeToString([]byte(htmlContent))))
+		tools = append(tools, htmlTool{name: "osascript", args: []string{"-"}, input: script})
+	case "windows":
+		tools = append(tools, htmlTool{
+			name:  "powershell",
+			args:  []string{"-NoProfile", "-Command", "Set-Clipboard -AsHtml -Value ([Console]::In.ReadToEnd())"},
+			input: htmlContent,
+		})
+	default:
+		if os.Getenv("WAYLAND_DISPLAY") != "" {
+			tools = append(tools, htmlTool{name: "wl-copy", args: []string{"--type", "text/html"}, input: htmlContent})
+		}
+		tools = append(tools, htmlTool{name: "xclip", args: []string{"-selection", "clipboard", "-t", "text/html"}, input: htmlContent})
+	}
+
+	for _, tool := range tools {
+		path, err := exec.LookPath(tool.name)
+		if err != nil {
+			continue
+		}
+
+		fmt.Fprintf(os.Stderr, "Attempting HTML clipboard copy via `%s`...\n", tool.name)
+		cmd := exec.Command(path, tool.args...)
+		cmd.Stdin = strings.NewReader(tool.input)
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to copy HTML with `%s`: %v\n", tool.name, err)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "HTML content copied to clipboard via `%s`.\n", tool.name)
+		return tool.name + " (html)"
+	}
+	return ""
+}
@@ -2,76 +2,205 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 	"unicode"
-
-	"golang.design/x/clipboard"
+	"unicode/utf16"
+	"unicode/utf8"
 )
 
-// isExcluded checks if a given path matches any of the glob patterns.
+// isExcluded applies the exclude patterns to a path unless the path, or one of its parent directories,
+// matches an -unignore pattern.
+func (p *processor) isExcluded(path string, excludePatterns []string) (bool, string) {
+	excluded, pattern := isExcluded(path, excludePatterns)
+	if !excluded || len(p.unignore) == 0 {
+		return excluded, pattern
+	}
+
+	parts := strings.Split(filepath.ToSlash(path), "/")
+	for i := range parts {
+		if unignored, override := isExcluded(strings.Join(parts[:i+1], "/"), p.unignore); unignored {
+			fmt.Fprintf(os.Stderr, "Keeping %s despite exclude pattern '%s' (unignored by '%s')\n", path, pattern, override)
+			return false, ""
+		}
+	}
+	return true, pattern
+}
+
+// isIncluded reports whether a file of a walk matches one of the -i include patterns, when there are any.
+func (p *processor) isIncluded(relativePath string) bool {
+	if len(p.includes) == 0 {
+		return true
+	}
+	included, _ := isExcluded(relativePath, p.includes)
+	return included
+}
+
+// vcsDirNames are the metadata directories of version control systems, pruned from walks with -exclude-vcs.
+var vcsDirNames = map[string]bool{
+	".git":   true,
+	".hg":    true,
+	".svn":   true,
+	".bzr":   true,
+	"CVS":    true,
+	"_darcs": true,
+}
+
+// hiddenSkipped reports whether a path whose name starts with a dot is left out: always,
+// unless includeHidden is set or the path matches one of the -hidden-allow patterns.
+func hiddenSkipped(relativePath string, includeHidden bool, allow []string) bool {
+	name := filepath.Base(relativePath)
+	if !strings.HasPrefix(name, ".") || name == "." || name == ".." || includeHidden {
+		return false
+	}
+	allowed, _ := isExcluded(relativePath, allow)
+	return !allowed
+}
+
+// matchIgnoreCase makes isExcluded case-insensitive, as set by -ignore-case. It defaults to
+// true on macOS and Windows, whose default filesystems are case-insensitive, like git there.
+var matchIgnoreCase = runtime.GOOS == "darwin" || runtime.GOOS == "windows"
+
+// isExcluded checks if a given path matches the glob patterns, returning the pattern as written.
+// Like in gitignore files, a pattern starting with '!' re-includes what earlier patterns excluded:
+// patterns apply in order and the last one matching the path decides.
 func isExcluded(path string, excludePatterns []string) (bool, string) {
 	if len(excludePatterns) == 0 {
 		return false, ""
 	}
 	// Use ToSlash for consistent matching across OSes
 	pathToCheck := filepath.ToSlash(path)
+	if matchIgnoreCase {
+		pathToCheck = strings.ToLower(pathToCheck)
+	}
 	baseName := filepath.Base(pathToCheck)
 
-	for _, pattern := range excludePatterns {
-		// Clean the pattern
-		pattern = strings.TrimSpace(pattern)
-		if pattern == "" {
+	excluded, matched := false, ""
+	for _, original := range excludePatterns {
+		// Patterns are trimmed when parsed; a trailing space left here was escaped on purpose
+		if original == "" || original == "!" {
 			continue
 		}
-
-		// Check 1: Match against the full relative path
-		matched, err := filepath.Match(pattern, pathToCheck)
-		if err != nil {
-			// Don't spam stderr for every file check if a pattern is bad,
-			// but usually we'd want to warn once. For now, strict match failure is ignored.
-			continue
+		pattern, negated := strings.CutPrefix(original, "!")
+		if matchIgnoreCase {
+			pattern = strings.ToLower(pattern)
 		}
-		if matched {
-			return true, pattern
+		if matchesPattern(pattern, pathToCheck, baseName) {
+			excluded, matched = !negated, original
+		}
+	}
+	if !excluded {
+		return false, ""
+	}
+	return true, matched
+}
+
+// matchesPattern checks a single glob pattern against a slash separated path and its base name.
+// As in gitignore, a leading slash anchors the pattern to the walk root (or the directory of its ignore file),
+// so "/dist" matches dist but not src/dist.
+func matchesPattern(pattern string, pathToCheck string, baseName string) bool {
+	anchored := strings.HasPrefix(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	// Check 1: Match against the full relative path
+	matched, err := globMatch(pattern, pathToCheck)
+	if err != nil {
+		// Don't spam stderr for every file check if a pattern is bad,
+		// but usually we'd want to warn once. For now, strict match failure is ignored.
+		return false
+	}
+	if matched {
+		return true
+	}
+
+	// Check 2: Git behavior - if pattern contains no slash (e.g. "*.log" or "node_modules"),
+	// it matches the file/dir name anywhere in the tree.
+	if !anchored && !strings.Contains(pattern, "/") {
+		matchedBase, _ := globMatch(pattern, baseName)
+		if matchedBase {
+			return true
 		}
+	}
 
-		// Check 2: Git behavior - if pattern contains no slash (e.g. "*.log" or "node_modules"),
-		// it matches the file/dir name anywhere in the tree.
-		if !strings.Contains(pattern, "/") {
-			matchedBase, _ := filepath.Match(pattern, baseName)
-			if matchedBase {
-				return true, pattern
+	// Check 3: Handle patterns ending in slash (e.g. "dist/") by matching directory name
+	if strings.HasSuffix(pattern, "/") {
+		cleanPattern := strings.TrimSuffix(pattern, "/")
+		if matched, _ := globMatch(cleanPattern, pathToCheck); matched {
+			return true
+		}
+		if !anchored && !strings.Contains(cleanPattern, "/") {
+			if matchedBase, _ := globMatch(cleanPattern, baseName); matchedBase {
+				return true
 			}
 		}
+	}
+	return false
+}
+
+// globMatch matches a slash separated path against a glob pattern like filepath.Match, where a "**"
+// path segment also matches any number of directories: "**/x" matches x at any depth, "a/**/b"
+// matches a/b and a/x/y/b, and "a/**" matches everything below a, but not a itself.
+func globMatch(pattern string, name string) (bool, error) {
+	if !strings.Contains(pattern, "**") {
+		return filepath.Match(pattern, name)
+	}
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
 
-		// Check 3: Handle patterns ending in slash (e.g. "dist/") by matching directory name
-		if strings.HasSuffix(pattern, "/") {
-			cleanPattern := strings.TrimSuffix(pattern, "/")
-			if matched, _ := filepath.Match(cleanPattern, pathToCheck); matched {
-				return true, pattern
+// matchSegments matches path segments against pattern segments, "**" consuming zero or more segments.
+func matchSegments(patterns []string, names []string) (bool, error) {
+	for len(patterns) > 0 {
+		if patterns[0] == "**" {
+			rest := patterns[1:]
+			if len(rest) == 0 {
+				// A trailing "**" needs something below the directory to match
+				return len(names) > 0, nil
 			}
-			if !strings.Contains(cleanPattern, "/") {
-				if matchedBase, _ := filepath.Match(cleanPattern, baseName); matchedBase {
-					return true, pattern
+			for i := 0; i <= len(names); i++ {
+				if matched, err := matchSegments(rest, names[i:]); matched || err != nil {
+					return matched, err
 				}
 			}
+			return false, nil
+		}
+		if len(names) == 0 {
+			return false, nil
+		}
+		if matched, err := filepath.Match(patterns[0], names[0]); !matched || err != nil {
+			return false, err
 		}
+		patterns, names = patterns[1:], names[1:]
 	}
-	return false, ""
+	return len(names) == 0, nil
 }
 
-// readGitIgnore looks for a .gitignore file in the given directory and returns its patterns.
-func readGitIgnore(dirPath string) []string {
-	gitIgnorePath := filepath.Join(dirPath, ".gitignore")
-	file, err := os.Open(gitIgnorePath)
+// readIgnoreFile looks for an ignore file with gitignore syntax (.gitignore, .terraformignore, ...)
+// in the given directory and returns its patterns.
+func readIgnoreFile(dirPath string, fileName string) []string {
+	ignorePath := filepath.Join(dirPath, fileName)
+	file, err := os.Open(ignorePath)
 	if err != nil {
 		// If file doesn't exist or can't be opened, just return empty
 		return nil
@@ -81,21 +210,120 @@ func readGitIgnore(dirPath string) []string {
 	var patterns []string
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		// Skip empty lines and comments
+		line := trimIgnoreLine(strings.TrimSuffix(scanner.Text(), "\r"))
+		// Skip empty lines and comments ("\#" is a literal '#', not a comment)
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
-		// In a real gitignore parser, '!' negates.
-		// For this simple implementation, we assume basic ignores and skip negations to avoid complexity.
-		if strings.HasPrefix(line, "!") {
-			continue
-		}
-		patterns = append(patterns, line)
+		// A leading '!' negates the pattern and is kept for isExcluded, while a leading "\!" is a literal '!'
+		patterns = append(patterns, unescapeIgnorePattern(line))
 	}
 	return patterns
 }
 
+// scopeIgnorePatterns rewrites the patterns of an ignore file found in dir, a slash separated path
+// relative to the walk root, so they match paths relative to the root but only below dir: patterns
+// with a slash are anchored to dir, the others match at any depth below it.
+func scopeIgnorePatterns(dir string, patterns []string) []string {
+	scoped := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		pattern, negated := strings.CutPrefix(pattern, "!")
+		if strings.Contains(strings.TrimSuffix(pattern, "/"), "/") {
+			pattern = dir + "/" + strings.TrimPrefix(pattern, "/")
+		} else {
+			pattern = dir + "/**/" + pattern
+		}
+		if negated {
+			pattern = "!" + pattern
+		}
+		scoped = append(scoped, pattern)
+	}
+	return scoped
+}
+
+// ignoredByAncestors checks a file argument against the ignore files of every directory above it,
+// nearest first, up to the root of its git repository. It returns the ignore file and pattern that matched.
+func (p *processor) ignoredByAncestors(absPath string, ignoreFiles []string) (bool, string, string) {
+	dir := filepath.Dir(absPath)
+	for {
+		rel, err := filepath.Rel(dir, absPath)
+		if err != nil {
+			return false, "", ""
+		}
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		for _, name := range ignoreFiles {
+			patterns := readIgnoreFile(dir, name)
+			if len(patterns) == 0 {
+				continue
+			}
+			// Like a walk from dir, a file is ignored when it or one of its parent directories matches
+			for i := range parts {
+				if excluded, pattern := p.isExcluded(strings.Join(parts[:i+1], "/"), patterns); excluded {
+					return true, filepath.Join(dir, name), pattern
+				}
+			}
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return false, "", ""
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return false, "", ""
+		}
+		dir = parent
+	}
+}
+
+// trimIgnoreLine drops trailing spaces from a gitignore line, keeping a final space escaped with a backslash.
+func trimIgnoreLine(line string) string {
+	end := len(line)
+	for end > 0 && line[end-1] == ' ' {
+		backslashes := 0
+		for i := end - 2; i >= 0 && line[i] == '\\'; i-- {
+			backslashes++
+		}
+		// An odd number of backslashes means the space itself is escaped
+		if backslashes%2 == 1 {
+			break
+		}
+		end--
+	}
+	return line[:end]
+}
+
+// unescapeIgnorePattern resolves the gitignore escapes for characters that are only special to gitignore
+// ('#', '!' and ' '), leaving glob escapes such as "\*" for the matcher.
+func unescapeIgnorePattern(pattern string) string {
+	if !strings.Contains(pattern, "\\") {
+		return pattern
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] == '\\' && i+1 < len(pattern) {
+			// A literal leading '!' stays escaped, which filepath.Match also reads as a literal '!'
+			if i == 0 && pattern[1] == '!' {
+				sb.WriteString(`\!`)
+				i++
+				continue
+			}
+			switch pattern[i+1] {
+			case '#', '!', ' ':
+				sb.WriteByte(pattern[i+1])
+				i++
+				continue
+			case '\\':
+				sb.WriteString(`\\`)
+				i++
+				continue
+			}
+		}
+		sb.WriteByte(pattern[i])
+	}
+	return sb.String()
+}
+
 // estimateTokens provides a more detailed heuristic for token counting.
 func estimateTokens(content string) (int, string) {
 	if content == "" {
@@ -142,6 +370,45 @@ func estimateTokens(content string) (int, string) {
 	return totalEstimate, details
 }
 
+// encodeBase64Output encodes content as wrapped base64, preceded by a single line explaining how to decode it.
+func encodeBase64Output(content string) string {
+	return "The text below is base64-encoded UTF-8; drop this line and decode the rest (e.g. `tail -n +2 | base64 -d`).\n" +
+		wrapBase64([]byte(content))
+}
+
+// wrapBase64 encodes data as base64 in lines of 76 characters, ending with a newline.
+func wrapBase64(data []byte) string {
+	encoded := base64.StdEncoding.EncodeToString(data)
+
+	var sb strings.Builder
+	for len(encoded) > 76 {
+		sb.WriteString(encoded[:76])
+		sb.WriteByte('\n')
+		encoded = encoded[76:]
+	}
+	sb.WriteString(encoded)
+	sb.WriteByte('\n')
+	return sb.String()
+}
+
+// tempClonePattern names the temporary directories -g clones into.
+const tempClonePattern = "fcopy-git-*"
+
+// stripTempPrefix removes a temporary clone directory, and everything before it, from a display path,
+// so paths under a clone are shown relative to the repository regardless of the temp directory name.
+func stripTempPrefix(displayPath string) string {
+	parts := strings.Split(filepath.ToSlash(displayPath), "/")
+	for i := len(parts) - 1; i >= 0; i-- {
+		if matched, _ := filepath.Match(tempClonePattern, parts[i]); matched {
+			if rest := strings.Join(parts[i+1:], "/"); rest != "" {
+				return rest
+			}
+			return "."
+		}
+	}
+	return displayPath
+}
+
 // getRepoName extracts a readable repository name from a URL to use as the base directory name.
 func getRepoName(url string) string {
 	parts := strings.Split(strings.TrimRight(url, "/"), "/")
@@ -156,22 +423,562 @@ func getRepoName(url string) string {
 	return name
 }
 
+// cleanups are run before the process exits, including when it exits early on a fatal error.
+var cleanups []func()
+
+// runCleanups runs the registered cleanups once, most recent first.
+func runCleanups() {
+	for i := len(cleanups) - 1; i >= 0; i-- {
+		cleanups[i]()
+	}
+	cleanups = nil
+}
+
+// fatalf prints an error message, runs the registered cleanups and exits with a non-zero status.
+func fatalf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	runCleanups()
+	os.Exit(1)
+}
+
+// processor accumulates the formatted output of a run along with the settings that shape it.
+type processor struct {
+	ctx          context.Context
+	timeout      time.Duration
+	formatter    formatter
+	contentDepth int
+	failOnError  bool
+	showMode     bool
+	showLines    bool
+	dedupContent bool
+	goOutline    bool
+	stdinRead    bool
+	stdinLang    string
+	blame        bool
+	excludeVCS   bool
+	groupByLang  bool
+	sortBy       string
+	sortReverse  bool
+	htmlMarkers  bool
+	skipLocks    bool
+
+	// pruneCommentsOnly skips files holding nothing but comments, such as a lone license header
+	pruneCommentsOnly bool
+
+	// gitMTime adds the date of the last commit touching each file to its header. The dates of a whole
+	// repository are read at once and cached in gitDates by repository root, with gitRoots caching the
+	// root of each directory ("" outside of a repository).
+	gitMTime bool
+	gitDates map[string]map[string]string
+	gitRoots map[string]string
+
+	// filters are shell commands each file's content is piped through, in order, before the other transforms.
+	filters []string
+
+	// regionStart and regionEnd are the marker comments delimiting the regions emitted from a file, if it has any.
+	regionStart string
+	regionEnd   string
+	dedent      bool
+
+	// maxSize caps text files; binary files, embedded as base64 with includeBinary, are capped by maxBinarySize.
+	// A zero limit disables the check.
+	maxSize       int64
+	maxBinarySize int64
+	includeBinary bool
+
+	// maxDirSize prunes directories whose total size on disk exceeds it (0 disables the check);
+	// dirSizes caches the size of every directory measured so far.
+	maxDirSize int64
+	dirSizes   map[string]int64
+
+	// onlyDirsWith keeps only the files of directories directly containing a file matching this glob;
+	// markerDirs caches the answer per directory.
+	onlyDirsWith string
+	markerDirs   map[string]bool
+
+	// Hidden files and directories are skipped unless includeHidden is set or they match a hiddenAllow pattern.
+	includeHidden bool
+	hiddenAllow   []string
+
+	// langOverrides forces the language hint of files by absolute path, from -lang-for and "path:lang=LANG".
+	langOverrides map[string]string
+
+	// renames are the -rename-display rewrites applied to display paths in the rendered output only.
+	renames []displayRename
+
+	// unignore patterns override the computed exclude set for matching paths and everything below them.
+	unignore []string
+
+	// ignoreFiles are the ignore file names read in every directory of a walk, their patterns applying
+	// to that directory's subtree, and globalExcludes the -x patterns, which stay after them.
+	ignoreFiles    []string
+	globalExcludes []string
+
+	// tokenReport shows the token count of each file as it is added, for -token-report.
+	tokenReport int
+
+	// includes are the -i patterns: when set, walks only keep the files matching one of them.
+	includes []string
+
+	// followSymlinks walks symlinked directories, and noEscape skips the symlinks resolving outside the walked directory.
+	followSymlinks bool
+	noEscape       bool
+
+	// jobs is the number of files of a directory walk read concurrently, ahead of their in-order processing.
+	jobs int
+
+	stats *runStats
+
+	// ownFiles are the absolute paths of fcopy's own inputs and outputs (-o, -summary-json, -prompt-to, -f,
+	// -prompt-template, ...), never picked up by directory walks so repeated in-place runs don't include themselves.
+	ownFiles map[string]bool
+
+	// maxLineLength treats files with longer lines (minified or dumped data) like large files,
+	// either skipping them or truncating the offending lines depending on truncateLongLines.
+	maxLineLength     int
+	truncateLongLines bool
+
+	// tests filters files following test conventions: "exclude" drops them, "only" keeps nothing else.
+	tests string
+
+	// maxMatches stops including files once that many were included; matchLimitHit records that it happened.
+	maxMatches    int
+	matchLimitHit bool
+
+	// repoMap replaces file contents with a single listing of each file's top-level declarations.
+	repoMap        bool
+	repoMapEntries []repoMapEntry
+
+	// stripTrailingSpace removes trailing spaces and tabs from every line of text files.
+	stripTrailingSpace bool
+
+	// dryRun lists the files that would be included in dryRunFiles instead of emitting them. Files are not
+	// read whole: their size and first bytes are enough for the binary and size checks.
+	dryRun      bool
+	dryRunFiles []dryRunEntry
+
+	// lineNumbers prefixes every line of text files with its number, after the other transforms.
+	lineNumbers bool
+
+	// expandTabs replaces tabs with spaces, at the width set by the nearest .editorconfig files, as
+	// lineNumbers also does so numbered lines align; editorConfigs caches the parsed .editorconfig of each
+	// directory looked at (nil when there is none).
+	expandTabs    bool
+	editorConfigs map[string]*editorConfigFile
+
+	// excludeContent drops files whose content matches, checked after the size and binary gates.
+	excludeContent *regexp.Regexp
+
+	// blocks are the formatted units of output, rendered once all targets have been processed.
+	blocks []outputBlock
+
+	// included records the display path of every file that made it into the output, in order.
+	included []string
+
+	// listed records the display path of the files past -content-depth, which only appear in trees.
+	listed []string
+}
+
+// outputBlock is a fenced section of the output: a file's content or a generated listing such as a tree.
+type outputBlock struct {
+	heading string // markdown written before the fence, e.g. a commit message
+	lang    string
+	title   string
+	notes   []string
+	content []byte
+	isFile  bool
+
+	htmlMarker bool   // wrap the fence in <!-- file: path --> comments, set for file blocks by -html-markers
+	absPath    string // file the content was read from, used by -sort mtime
+}
+
+// reportError prints a per-file error; with -fail-on-error it aborts the whole run instead of continuing.
+func (p *processor) reportError(format string, args ...any) {
+	p.stats.errors++
+	if p.failOnError {
+		fatalf(format, args...)
+	}
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+}
+
+// withEmptyOutput returns a processor sharing p's settings but with its own empty output,
+// used to render sections such as the -f file separately from the main file blocks.
+func (p *processor) withEmptyOutput() *processor {
+	c := *p
+	c.blocks = nil
+	c.included = nil
+	c.listed = nil
+	// The -max-matches guard protects against broad targets, not against the extra sections
+	c.maxMatches = 0
+	return &c
+}
+
+// checkTimeout aborts the run, cleaning up temporary files, once the -timeout deadline has passed.
+func (p *processor) checkTimeout() {
+	if errors.Is(p.ctx.Err(), context.DeadlineExceeded) {
+		fatalf("Error: timeout of %s exceeded, aborting.", p.timeout)
+	}
+}
+
+// promptSections holds the separately rendered parts of the final output.
+type promptSections struct {
+	examples string
+	files    string
+	tree     string
+	prompt   string
+	followUp string
+}
+
+// defaultLayout is the section order used by join when -layout is not given.
+const defaultLayout = "examples,files,prompt,followup"
+
+// section returns the rendered section called name in -layout and template placeholders.
+func (s promptSections) section(name string) (string, bool) {
+	switch name {
+	case "examples":
+		return s.examples, true
+	case "files":
+		return s.files, true
+	case "tree":
+		return s.tree, true
+	case "prompt":
+		return s.prompt, true
+	case "followup":
+		return s.followUp, true
+	}
+	return "", false
+}
+
+// parseLayout validates a comma-separated -layout value and returns its section names.
+func parseLayout(layout string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(layout, ",") {
+		name = strings.TrimSpace(name)
+		if _, ok := (promptSections{}).section(name); !ok {
+			return nil, fmt.Errorf("unknown section '%s' (want examples, files, tree, prompt or followup)", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// join concatenates the non-empty sections in the given order, separated by a blank line.
+func (s promptSections) join(layout []string) string {
+	var parts []string
+	for _, name := range layout {
+		if part, _ := s.section(name); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// renderTemplate substitutes the {{examples}}, {{files}}, {{tree}}, {{prompt}} and {{followup}} placeholders in tmpl.
+func (s promptSections) renderTemplate(tmpl string) string {
+	return strings.NewReplacer(
+		"{{examples}}", s.examples,
+		"{{files}}", s.files,
+		"{{tree}}", s.tree,
+		"{{prompt}}", s.prompt,
+		"{{followup}}", s.followUp,
+	).Replace(tmpl)
+}
+
+// loadPromptTemplate returns the template given to -prompt-template, reading it from disk when prefixed with '@'.
+func loadPromptTemplate(value string) (string, error) {
+	if !strings.HasPrefix(value, "@") {
+		return value, nil
+	}
+	content, err := os.ReadFile(strings.TrimPrefix(value, "@"))
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+// unescapeDelimiter interprets backslash escapes such as \n and \t in a user supplied delimiter.
+func unescapeDelimiter(delimiter string) string {
+	if !strings.Contains(delimiter, "\\") {
+		return delimiter
+	}
+	unquoted, err := strconv.Unquote(`"` + strings.ReplaceAll(delimiter, `"`, `\"`) + `"`)
+	if err != nil {
+		return delimiter
+	}
+	return unquoted
+}
+
+// readPathList reads a list of paths from a file, or from stdin when source is "-".
+// Paths are newline-separated, or NUL-separated when nullSeparated is set; empty entries are ignored.
+func readPathList(source string, nullSeparated bool) ([]string, error) {
+	var data []byte
+	var err error
+	if source == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(source)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	separator := "\n"
+	if nullSeparated {
+		separator = "\x00"
+	}
+	var paths []string
+	for _, entry := range strings.Split(string(data), separator) {
+		if !nullSeparated {
+			entry = strings.TrimSuffix(entry, "\r")
+		}
+		if entry != "" {
+			paths = append(paths, entry)
+		}
+	}
+	return paths, nil
+}
+
+// parseSize parses a byte size such as "512", "64K", "10MB" or "1GiB"; units are powers of 1024.
+func parseSize(value string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	multiplier := int64(1)
+	if s != "" {
+		if idx := strings.IndexByte("KMGT", s[len(s)-1]); idx >= 0 {
+			multiplier = int64(1) << (10 * (idx + 1))
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("'%s' is not a size like 512K, 10M or 1G", value)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// dirHasMatch reports whether dir directly contains a file whose name matches the -only-dirs-with pattern,
+// caching the answer per directory.
+func (p *processor) dirHasMatch(dir string) bool {
+	if matched, ok := p.markerDirs[dir]; ok {
+		return matched
+	}
+	matched := false
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if ok, _ := filepath.Match(p.onlyDirsWith, entry.Name()); ok && !entry.IsDir() {
+			matched = true
+			break
+		}
+	}
+	p.markerDirs[dir] = matched
+	return matched
+}
+
+// dirSize returns the total size of the regular files below dir, caching the result for dir
+// and every subdirectory so nested checks during the same walk are free.
+func (p *processor) dirSize(dir string) int64 {
+	if size, ok := p.dirSizes[dir]; ok {
+		return size
+	}
+	var size int64
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			size += p.dirSize(filepath.Join(dir, entry.Name()))
+		} else if entry.Type().IsRegular() {
+			if info, err := entry.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+	}
+	p.dirSizes[dir] = size
+	return size
+}
+
+// displayRename is a -rename-display rule replacing the display path prefix from with to.
+type displayRename struct {
+	from string
+	to   string
+}
+
+// stringList is a flag.Value collecting every occurrence of a repeatable flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 // target represents a file system location to process
 type target struct {
 	absPath     string
 	displayBase string
 	isDir       bool
+	isStdin     bool
+	mode        string // a targetModes entry given as a "path:mode" suffix, or "" for the full content
+	header      string // text given as a "path:::header" suffix, written before the target's blocks
+}
+
+// splitTargetHeader separates a "path:::header" argument into its path and header.
+// An argument naming an existing path is never split.
+func splitTargetHeader(arg string) (string, string) {
+	if _, err := os.Stat(arg); err == nil {
+		return arg, ""
+	}
+	path, header, ok := strings.Cut(arg, ":::")
+	if !ok {
+		return arg, ""
+	}
+	return path, strings.TrimSpace(header)
+}
+
+// targetModes are the suffixes accepted after a path argument to change how it is emitted, e.g. "main.go:diff".
+var targetModes = map[string]bool{
+	"diff":  true,
+	"blame": true,
+}
+
+// splitTargetSuffixes strips the ":mode" and ":lang=LANG" suffixes from a path argument, in any order,
+// returning the path, the mode and the forced language hint.
+// An argument naming an existing path is never split, so paths containing colons keep working.
+func splitTargetSuffixes(arg string) (path string, mode string, lang string) {
+	path = arg
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path, mode, lang
+		}
+		idx := strings.LastIndex(path, ":")
+		if idx <= 0 {
+			return path, mode, lang
+		}
+		suffix := path[idx+1:]
+		if targetModes[suffix] && mode == "" {
+			mode = suffix
+		} else if value, ok := strings.CutPrefix(suffix, "lang="); ok && value != "" && lang == "" {
+			lang = value
+		} else {
+			return path, mode, lang
+		}
+		path = path[:idx]
+	}
 }
 
 func main() {
 	// Define flags
 	promptPtr := flag.String("p", "", "A prompt to append after the main file contents")
 	followUpFilePtr := flag.String("f", "", "Path to a file whose content will be appended after the prompt, formatted as markdown")
-	outputFilePtr := flag.String("o", "", "Output to the specified file instead of clipboard")
-	stdoutPtr := flag.Bool("s", false, "Output to stdout instead of clipboard")
+	outputFilePtr := flag.String("o", "", "Output to the specified file instead of clipboard (combinable with -s and -c)")
+	stdoutPtr := flag.Bool("s", false, "Output to stdout instead of clipboard (combinable with -o and -c)")
+	clipboardPtr := flag.Bool("c", false, "Also copy to the clipboard when -s or -o is used")
+	promptToPtr := flag.String("prompt-to", "", "Send the -p prompt and -f file to their own sink instead of after the files: stdout, stderr, clipboard or a file path")
 	termCopyPtr := flag.Bool("t", false, "Use terminal-aware clipboard (OSC 52, kitty), ideal for SSH")
 	excludePatternsPtr := flag.String("x", "", "Comma-separated list of glob patterns to exclude (e.g., '.git,*.log,dist/*')")
+	includePatternsPtr := flag.String("i", "", "Comma-separated list of glob patterns files must match to be included (e.g., '*.go,*.md'); directories are still walked, and excludes take precedence")
 	gitRepoPtr := flag.String("g", "", "Git repository URL to clone and process (shallow clone)")
+	contentDepthPtr := flag.Int("content-depth", 0, "Only include the content of files up to this directory depth; deeper files are listed in a tree (0 = no limit)")
+	promptTemplatePtr := flag.String("prompt-template", "", "Template arranging the output, inline or '@file'; placeholders: {{examples}}, {{files}}, {{tree}}, {{prompt}}, {{followup}}")
+	outputMarkdownPtr := flag.String("o-markdown", "", "Also write the output as markdown to this file, whatever -format is (combinable with -o-json)")
+	outputJSONPtr := flag.String("o-json", "", "Also write the output as JSON to this file, whatever -format is (combinable with -o-markdown)")
+	formatPtr := flag.String("format", "markdown", "Output format: 'markdown', 'json' for an array of {path, language, content} (token estimate covers the JSON), or 'xml' for <file path=\"...\"> elements in a <documents> root")
+	clipFormatPtr := flag.String("clip-format", "text", "Clipboard flavor: 'text', or 'html' to paste the markdown rendered as rich text")
+	ignoreFilesPtr := flag.String("ignore-files", ".gitignore", "Comma-separated ignore files (gitignore syntax) read from each target directory, e.g. '.gitignore,.npmignore'")
+	maxSizePtr := flag.String("max-file-size", "1M", "Skip text files larger than this (e.g. '500k', '2M', '10MB'; 0 for no limit)")
+	flag.StringVar(maxSizePtr, "max-size", "1M", "Alias of -max-file-size")
+	includeBinaryPtr := flag.Bool("include-binary", false, "Embed binary files as base64 blocks instead of skipping them")
+	maxBinarySizePtr := flag.String("max-binary-size", "256K", "Skip binary files larger than this when -include-binary is set (0 for no limit)")
+	onlyDirsWithPtr := flag.String("only-dirs-with", "", "In directory walks, only include files from directories that directly contain a file matching this glob (e.g. 'handler.go')")
+	maxDirSizePtr := flag.String("max-dir-size", "", "Skip subdirectories whose total size exceeds this, before any filtering (e.g. '50M'); path arguments are always walked")
+	includeLockfilesPtr := flag.Bool("include-lockfiles", false, "Include dependency lock files (go.sum, Cargo.lock, package-lock.json, ...) found while walking directories")
+	excludeVCSPtr := flag.Bool("exclude-vcs", true, "Prune version control metadata directories (.git, .hg, .svn, .bzr, CVS, _darcs) regardless of ignore files")
+	applyIgnoreToArgsPtr := flag.Bool("apply-gitignore-to-args", false, "Skip file arguments ignored by the ignore files of their parent directories, up to the repository root (e.g. with 'fcopy *')")
+	followSymlinksPtr := flag.Bool("follow-symlinks", false, "Descend into symlinked directories while walking; a directory already entered, by its real path, is skipped so links cannot loop or repeat it")
+	noEscapePtr := flag.Bool("no-escape", false, "Skip symlinks pointing outside the walked directory, with a warning")
+	fcopyIgnorePtr := flag.String("fcopyignore", ".fcopyignore", "Ignore file for fcopy only, read in every directory like the -ignore-files ('' to disable)")
+	noGitignorePtr := flag.Bool("no-gitignore", false, "Don't read .gitignore files, keeping the files they exclude; -x patterns and other -ignore-files still apply")
+	terraformIgnorePtr := flag.Bool("terraformignore", false, "Also exclude patterns listed in a .terraformignore file")
+	showLinesPtr := flag.Bool("show-lines", false, "Show the line count of each file in its header")
+	showModePtr := flag.Bool("show-mode", false, "Show file permission bits in each file header and flag executables")
+	excludeContentPtr := flag.String("exclude-content", "", "Skip files whose content matches this regular expression (e.g. '@generated')")
+	goOutlinePtr := flag.Bool("go-outline", false, "Condense Go files to package, imports, types and function signatures (bodies elided)")
+	groupByLangPtr := flag.Bool("group-by-language", false, "Cluster files by language under '## <language>' headings instead of walk order")
+	gitMTimePtr := flag.Bool("git-mtime", false, "Show the date of the last commit touching each file in its header, for files in a git repository")
+	regionStartPtr := flag.String("region-start", "", "Marker comment opening a region, e.g. fcopy-start: files with markers only emit their regions (regions are off when empty)")
+	regionEndPtr := flag.String("region-end", "fcopy-end", "Marker comment closing a region opened by -region-start")
+	sortPtr := flag.String("sort", "", "Reorder file blocks by 'path', 'size', 'tokens' or 'mtime' (largest or newest first) instead of walk order")
+	sortReversePtr := flag.Bool("sort-reverse", false, "Reverse the -sort order, e.g. smallest files first")
+	dedentPtr := flag.Bool("dedent", false, "Remove the leading indentation common to all lines of each file or -region-start region, keeping relative indentation")
+	pruneCommentsOnlyPtr := flag.Bool("prune-comments-only-files", false, "Skip files with nothing but comments and blank lines, like lone license headers")
+	htmlMarkersPtr := flag.Bool("html-markers", false, "Wrap each file block in <!-- file: path --> and <!-- end file: path --> comments, for destinations that mangle markdown")
+	dedupContentPtr := flag.Bool("dedup-content", false, "Emit byte-identical files once, listing the other paths as aliases")
+	base64OutPtr := flag.Bool("base64-out", false, "Emit the whole output base64-encoded, after a one-line decoding note, for byte-exact transport")
+	excludeTestsPtr := flag.Bool("exclude-tests", false, "Skip test files (_test.go, test_*.py, *.test.js, *_spec.rb, files under tests/, ...)")
+	onlyTestsPtr := flag.Bool("only-tests", false, "Only include test files, as recognized by -exclude-tests")
+	maxMatchesPtr := flag.Int("max-matches", 0, "Stop including files once this many have been included, warning when the limit is hit (0 for no limit)")
+	repoMapPtr := flag.Bool("repo-map", false, "Emit a compact map of the top-level declarations of each file instead of their contents")
+	expandTabsPtr := flag.Bool("expand-tabs", false, "Replace tabs with spaces, using the tab_width or indent_size of the nearest .editorconfig (default 8)")
+	lineNumbersPtr := flag.Bool("line-numbers", false, "Prefix every line of the included files with its right-aligned number, as '  42 | code', expanding tabs like -expand-tabs")
+	stripTrailingSpacePtr := flag.Bool("strip-trailing-whitespace", false, "Remove trailing spaces and tabs from every line of the included files")
+	maxLineLengthPtr := flag.Int("max-line-length", 0, "Treat files with lines longer than this many bytes as oversized (0 = no limit)")
+	longLinesPtr := flag.String("long-lines", "skip", "What to do with files over -max-line-length: 'skip' or 'truncate' the long lines")
+	var commands stringList
+	var filters stringList
+	var unignorePatterns stringList
+	var examplePaths stringList
+	var renameDisplays stringList
+	var langFor stringList
+	flag.Var(&langFor, "lang-for", "Force the language hint of one file as 'path=lang', e.g. 'schema.txt=sql' (repeatable, same as a 'path:lang=sql' argument)")
+	var hiddenAllowPatterns stringList
+	flag.Var(&hiddenAllowPatterns, "hidden-allow", "Include hidden files or directories matching this glob pattern, e.g. '.github' or '.golangci.yml' (repeatable)")
+	includeHiddenPtr := flag.Bool("hidden", false, "Include all hidden files and directories (VCS metadata stays pruned by -exclude-vcs)")
+	flag.Var(&renameDisplays, "rename-display", "Rewrite a display path prefix in the output as 'old=new', e.g. 'internal/secretproj/=app/' (repeatable)")
+	flag.Var(&examplePaths, "examples", "File or directory of few-shot examples, rendered as its own section placed by -layout (repeatable)")
+	treePtr := flag.Bool("tree", false, "Show a tree of the included files in a fenced block before them (same as adding 'tree' to -layout, fenced)")
+	layoutPtr := flag.String("layout", defaultLayout, "Comma-separated order of the output sections: examples, files, tree, prompt, followup")
+	flag.Var(&unignorePatterns, "unignore", "Include paths matching this glob pattern even if -x or an ignore file excludes them (repeatable, e.g. 'dist/')")
+	flag.Var(&filters, "filter", "Pipe each file's content through this shell command, its stdout replacing the content; the path is in $FCOPY_PATH (repeatable, chained in order)")
+	flag.Var(&commands, "cmd", "Run a shell command and include its output as a block, as 'command' or 'header:::command' (repeatable)")
+	cmdTimeoutPtr := flag.Duration("cmd-timeout", 30*time.Second, "Maximum run time of each -cmd command")
+	summaryJSONPtr := flag.String("summary-json", "", "Write a JSON summary of the run (files, skips, bytes, tokens, backend, duration) to this file, or '-' for stderr")
+	timeoutPtr := flag.Duration("timeout", 0, "Abort if the whole operation takes longer than this (e.g. 30s, 2m; 0 = no limit)")
+	clipRetriesPtr := flag.Int("clip-retries", 0, "Retry failed clipboard copies this many times (also verifies the library copy and re-sends OSC 52)")
+	failOnErrorPtr := flag.Bool("fail-on-error", false, "Exit with an error instead of skipping files that cannot be read")
+	blamePtr := flag.Bool("blame", false, "Prefix every line of files tracked by git with the short hash and author that last changed it (same as a 'path:blame' argument)")
+	diffPtr := flag.Bool("diff", false, "Emit 'git diff HEAD' for each path argument instead of its content (same as a 'path:diff' argument)")
+	commitsPtr := flag.String("commits", "", "Emit the message and diff of each commit in a git range (e.g. main..HEAD) for the given paths")
+	gitSubmodulesPtr := flag.Bool("g-submodules", false, "Also clone the submodules of the -g repository (shallow), so their code is included")
+	gitRefPtr := flag.String("g-ref", "", "Branch or tag of the -g repository to clone instead of its default branch")
+	gitSubdirPtr := flag.String("g-subdir", "", "Only process this subdirectory of the -g repository, e.g. 'packages/api'")
+	gitQuietPtr := flag.Bool("g-quiet", false, "Hide git's clone progress output for -g, only showing errors")
+	stripTempPtr := flag.Bool("strip-temp", true, "Show paths inside fcopy-git-* temporary clones relative to the repository")
+	costPtr := flag.String("cost", "", "Print the estimated input cost for this model next to the token count (see -list-models)")
+	costPerMTokPtr := flag.Float64("cost-per-mtok", 0, "Input price in USD per million tokens, overriding the built-in price of the -cost model")
+	tokenReportPtr := flag.Int("token-report", 0, "Show each file's token count as it is added, then the N files with the most tokens and how they add up to the total")
+	tokenizerPtr := flag.String("tokenizer", "", "Count tokens exactly with this encoding instead of estimating them: 'cl100k' (ranks downloaded once to the user cache)")
+	modelPtr := flag.String("model", "", "Warn when the estimated token count exceeds this model's context window (see -list-models)")
+	listModelsPtr := flag.Bool("list-models", false, "Print the built-in model prices and context windows used by -cost and -model and exit")
+	listLanguagesPtr := flag.Bool("list-languages", false, "Print the built-in file name and extension to language mappings and exit")
+	atRevPtr := flag.String("at-rev", "", "Read tracked files as they were at this git revision (commit, tag, stash@{0}) instead of the working tree")
+	noTrailingNewlinePtr := flag.Bool("no-trailing-newline", false, "Strip trailing newlines from the end of the output (use -delimiter to size the gaps between files)")
+	stdinNamePtr := flag.String("stdin-name", "stdin", "Display name for content read from '-'; its extension also picks the language hint")
+	stdinLangPtr := flag.String("stdin-lang", "", "Language hint for content read from '-', overriding the one derived from -stdin-name")
+	filesFromPtr := flag.String("files-from", "", "Read additional paths to process from this file, or '-' for stdin (one per line)")
+	jobsPtr := flag.Int("jobs", runtime.GOMAXPROCS(0), "Number of files read concurrently while walking directories; the output order is unchanged")
+	stdinPathsPtr := flag.Bool("stdin", false, "Read the paths to process from stdin, one per line (same as -files-from -)")
+	nullPtr := flag.Bool("null", false, "Paths for -files-from and -paths-only are NUL-separated, as with find -print0")
+	watchPtr := flag.Bool("watch", false, "Keep running and redo the copy whenever a file under the path arguments changes (Ctrl-C to stop)")
+	chunkTokensPtr := flag.Int("chunk-tokens", 0, "Report how the output would split into chunks of at most N tokens at file boundaries, for multi-message pastes")
+	dryRunPtr := flag.Bool("dry-run", false, "Print the files that would be included, with their size and language, and the skip counts to stdout, then exit without reading them whole")
+	pathsOnlyPtr := flag.Bool("paths-only", false, "Only print the paths of the files that would be included to stdout, one per line, and exit")
+	ignoreCasePtr := flag.Bool("ignore-case", matchIgnoreCase, "Match exclude and ignore file patterns case-insensitively (default on macOS and Windows)")
+	profilePtr := flag.String("profile", "", "Load the flags of this [profile] section of .fcopyrc or the user config file; command-line flags take precedence")
+	delimiterPtr := flag.String("delimiter", "\n\n", "Separator written between file blocks (escapes like \\n are interpreted)")
 
 	// Custom usage message
 	flag.Usage = func() {
@@ -179,93 +986,546 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [options] <path1> [path2 ...]\n", progName)
 		fmt.Fprintf(os.Stderr, "Processes files, directories, or git repositories, formats them as markdown.\n")
 		fmt.Fprintf(os.Stderr, "\nArguments:\n")
-		fmt.Fprintf(os.Stderr, "  <path1> [path2 ...]  Paths to files or directories to process.\n")
+		fmt.Fprintf(os.Stderr, "  <path1> [path2 ...]  Paths to files or directories to process ('-' reads content from stdin).\n")
 		fmt.Fprintf(os.Stderr, "\nOptions:\n")
 		flag.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "\nExamples:\n")
 		fmt.Fprintf(os.Stderr, "  %s internal/ README.md\n", progName)
 		fmt.Fprintf(os.Stderr, "  %s -g https://github.com/user/repo\n", progName)
 		fmt.Fprintf(os.Stderr, "  %s -p \"Refactor this\" main.go\n", progName)
+		fmt.Fprintf(os.Stderr, "  %s -at-rev HEAD~3 internal/\n", progName)
+		fmt.Fprintf(os.Stderr, "  %s -commits main..HEAD -p \"Summarize this branch\"\n", progName)
+		fmt.Fprintf(os.Stderr, "  %s -p \"Find the bug\" -prompt-template @review.tmpl src/\n", progName)
+		fmt.Fprintf(os.Stderr, "\nPrompt template placeholders:\n")
+		fmt.Fprintf(os.Stderr, "  {{examples}}  The formatted -examples files\n")
+		fmt.Fprintf(os.Stderr, "  {{files}}     The formatted file blocks\n")
+		fmt.Fprintf(os.Stderr, "  {{tree}}      A tree of the included file paths\n")
+		fmt.Fprintf(os.Stderr, "  {{prompt}}    The -p prompt text\n")
+		fmt.Fprintf(os.Stderr, "  {{followup}}  The formatted -f file\n")
 	}
 
 	flag.Parse()
 
-	// Check for mutually exclusive output options
-	if *stdoutPtr && *outputFilePtr != "" {
-		fmt.Fprintf(os.Stderr, "Error: -s (stdout) and -o (output file) options are mutually exclusive.\n\n")
+	if err := applyConfig(*profilePtr); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: config: %v\n\n", err)
 		flag.Usage()
 		os.Exit(1)
 	}
+	matchIgnoreCase = *ignoreCasePtr
 
-	// Parse command line exclude patterns
-	var globalExcludePatterns []string
-	if *excludePatternsPtr != "" {
-		patterns := strings.Split(*excludePatternsPtr, ",")
-		for _, p := range patterns {
-			trimmed := strings.TrimSpace(p)
-			if trimmed != "" {
-				globalExcludePatterns = append(globalExcludePatterns, trimmed)
-			}
-		}
+	if *listLanguagesPtr {
+		printLanguages(os.Stdout)
+		return
+	}
+	if *listModelsPtr {
+		printModels(os.Stdout)
+		return
 	}
 
-	argPaths := flag.Args()
+	// The clipboard holds a single content, so the files and the prompt cannot both go there
+	if *promptToPtr == "clipboard" && ((!*stdoutPtr && *outputFilePtr == "") || *clipboardPtr) {
+		fmt.Fprintf(os.Stderr, "Error: -prompt-to clipboard needs the files to go to -s or -o, without -c.\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
 
-	// Validate we have something to do
-	if len(argPaths) == 0 && *gitRepoPtr == "" && *promptPtr == "" && *followUpFilePtr == "" {
+	// The OSC 52 sequence is written to stdout, where it would be mixed into the -s output
+	if *stdoutPtr && *clipboardPtr && *termCopyPtr {
+		fmt.Fprintf(os.Stderr, "Error: -t cannot be combined with -s and -c, as both write to stdout.\n\n")
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	var outputBuilder strings.Builder
-	var targetsToProcess []target
+	if *formatPtr != "markdown" && *formatPtr != "json" && *formatPtr != "xml" {
+		fmt.Fprintf(os.Stderr, "Error: -format must be 'markdown', 'json' or 'xml', got '%s'.\n\n", *formatPtr)
+		flag.Usage()
+		os.Exit(1)
+	}
 
-	// Handle Git Repository if -g is provided
-	if *gitRepoPtr != "" {
-		if _, err := exec.LookPath("git"); err != nil {
-			log.Fatal("Error: 'git' command not found in PATH. Required for -g flag.")
-		}
+	if *longLinesPtr != "skip" && *longLinesPtr != "truncate" {
+		fmt.Fprintf(os.Stderr, "Error: -long-lines must be 'skip' or 'truncate', got '%s'.\n\n", *longLinesPtr)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *clipFormatPtr != "text" && *clipFormatPtr != "html" {
+		fmt.Fprintf(os.Stderr, "Error: -clip-format must be 'text' or 'html', got '%s'.\n\n", *clipFormatPtr)
+		flag.Usage()
+		os.Exit(1)
+	}
 
-		tempDir, err := os.MkdirTemp("", "fcopy-git-*")
+	var pricePerMTok float64
+	if *costPtr != "" || *costPerMTokPtr > 0 {
+		var err error
+		pricePerMTok, err = resolveModelPrice(*costPtr, *costPerMTokPtr)
 		if err != nil {
-			log.Fatalf("Error creating temporary directory: %v", err)
+			fmt.Fprintf(os.Stderr, "Error: -cost: %v.\n\n", err)
+			flag.Usage()
+			os.Exit(1)
 		}
-		defer func() {
-			fmt.Fprintf(os.Stderr, "Cleaning up temp directory: %s\n", tempDir)
-			os.RemoveAll(tempDir)
-		}()
-
-		repoURL := *gitRepoPtr
-		fmt.Fprintf(os.Stderr, "Cloning %s into temporary directory...\n", repoURL)
+	}
 
-		cmd := exec.Command("git", "clone", "--depth", "1", repoURL, tempDir)
-		cmd.Stderr = os.Stderr
-		cmd.Stdout = os.Stderr
-		if err := cmd.Run(); err != nil {
-			log.Fatalf("Error cloning repository: %v", err)
-		}
+	if *tokenizerPtr != "" && *tokenizerPtr != "cl100k" {
+		fmt.Fprintf(os.Stderr, "Error: -tokenizer must be 'cl100k', got '%s'.\n\n", *tokenizerPtr)
+		flag.Usage()
+		os.Exit(1)
+	}
 
-		repoName := getRepoName(repoURL)
-		targetsToProcess = append(targetsToProcess, target{
-			absPath:     tempDir,
-			displayBase: repoName,
-			isDir:       true,
-		})
+	if *sortPtr != "" && !slices.Contains(sortKeys, *sortPtr) {
+		fmt.Fprintf(os.Stderr, "Error: -sort must be one of %s, got '%s'.\n\n", strings.Join(sortKeys, ", "), *sortPtr)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *jobsPtr < 1 {
+		fmt.Fprintf(os.Stderr, "Error: -jobs must be at least 1, got %d.\n\n", *jobsPtr)
+		flag.Usage()
+		os.Exit(1)
 	}
 
-	// Handle standard positional arguments
-	for _, argPath := range argPaths {
-		absPath, err := filepath.Abs(argPath)
+	var contextWindow int
+	if *modelPtr != "" {
+		var err error
+		contextWindow, err = resolveContextWindow(*modelPtr)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error getting absolute path for %s: %v\n", argPath, err)
-			continue
+			fmt.Fprintf(os.Stderr, "Error: -model: %v.\n\n", err)
+			flag.Usage()
+			os.Exit(1)
 		}
+	}
 
-		info, err := os.Stat(absPath)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error stating path %s: %v\n", argPath, err)
-			continue
-		}
+	maxSize, err := parseSize(*maxSizePtr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid -max-file-size: %v\n\n", err)
+		flag.Usage()
+		os.Exit(1)
+	}
+	maxBinarySize, err := parseSize(*maxBinarySizePtr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid -max-binary-size: %v\n\n", err)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if _, err := filepath.Match(*onlyDirsWithPtr, ""); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid -only-dirs-with pattern: %v\n\n", err)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	tests := ""
+	switch {
+	case *excludeTestsPtr && *onlyTestsPtr:
+		fmt.Fprintf(os.Stderr, "Error: -exclude-tests and -only-tests options are mutually exclusive.\n\n")
+		flag.Usage()
+		os.Exit(1)
+	case *excludeTestsPtr:
+		tests = "exclude"
+	case *onlyTestsPtr:
+		tests = "only"
+	}
+
+	var maxDirSize int64
+	if *maxDirSizePtr != "" {
+		var err error
+		maxDirSize, err = parseSize(*maxDirSizePtr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid -max-dir-size: %v\n\n", err)
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+
+	var excludeContent *regexp.Regexp
+	if *excludeContentPtr != "" {
+		var err error
+		excludeContent, err = regexp.Compile(*excludeContentPtr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid -exclude-content expression: %v\n\n", err)
+			flag.Usage()
+			os.Exit(1)
+		}
+	}
+
+	var promptTemplate string
+	if *promptTemplatePtr != "" {
+		var err error
+		promptTemplate, err = loadPromptTemplate(*promptTemplatePtr)
+		if err != nil {
+			log.Fatalf("Error reading prompt template %s: %v", *promptTemplatePtr, err)
+		}
+	}
+
+	// Parse command line exclude patterns
+	var globalExcludePatterns []string
+	if *excludePatternsPtr != "" {
+		patterns := strings.Split(*excludePatternsPtr, ",")
+		for _, p := range patterns {
+			trimmed := strings.TrimSpace(p)
+			if trimmed != "" {
+				globalExcludePatterns = append(globalExcludePatterns, trimmed)
+			}
+		}
+	}
+
+	var includePatterns []string
+	for _, pattern := range strings.Split(*includePatternsPtr, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			includePatterns = append(includePatterns, pattern)
+		}
+	}
+
+	var ignoreFiles []string
+	for _, name := range strings.Split(*ignoreFilesPtr, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			ignoreFiles = append(ignoreFiles, name)
+		}
+	}
+	if *noGitignorePtr {
+		ignoreFiles = slices.DeleteFunc(ignoreFiles, func(name string) bool { return name == ".gitignore" })
+	}
+	if *fcopyIgnorePtr != "" && !slices.Contains(ignoreFiles, *fcopyIgnorePtr) {
+		ignoreFiles = append(ignoreFiles, *fcopyIgnorePtr)
+	}
+	if *terraformIgnorePtr && !slices.Contains(ignoreFiles, ".terraformignore") {
+		ignoreFiles = append(ignoreFiles, ".terraformignore")
+	}
+
+	argPaths := flag.Args()
+
+	// -stdin is a shorthand for reading the path list from stdin, as in 'git diff --name-only | fcopy -stdin'
+	if *stdinPathsPtr {
+		if *filesFromPtr != "" && *filesFromPtr != "-" {
+			fmt.Fprintf(os.Stderr, "Error: -stdin and -files-from %s both give the path list.\n\n", *filesFromPtr)
+			flag.Usage()
+			os.Exit(1)
+		}
+		*filesFromPtr = "-"
+	}
+
+	// Paths listed with -files-from are processed after the positional arguments
+	stdinConsumed := false
+	if *filesFromPtr != "" {
+		listedPaths, err := readPathList(*filesFromPtr, *nullPtr)
+		if err != nil {
+			log.Fatalf("Error reading -files-from %s: %v", *filesFromPtr, err)
+		}
+		fmt.Fprintf(os.Stderr, "Read %d path(s) from %s.\n", len(listedPaths), *filesFromPtr)
+		argPaths = append(argPaths, listedPaths...)
+		stdinConsumed = *filesFromPtr == "-"
+	}
+
+	langOverrides := make(map[string]string)
+	for _, value := range langFor {
+		path, lang, ok := strings.Cut(value, "=")
+		absPath, err := filepath.Abs(path)
+		if !ok || path == "" || lang == "" || err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -lang-for must be 'path=lang', got '%s'.\n\n", value)
+			flag.Usage()
+			os.Exit(1)
+		}
+		langOverrides[absPath] = lang
+	}
+
+	var renames []displayRename
+	for _, value := range renameDisplays {
+		from, to, ok := strings.Cut(value, "=")
+		if !ok || from == "" {
+			fmt.Fprintf(os.Stderr, "Error: -rename-display must be 'old=new', got '%s'.\n\n", value)
+			flag.Usage()
+			os.Exit(1)
+		}
+		renames = append(renames, displayRename{from: filepath.ToSlash(from), to: filepath.ToSlash(to)})
+	}
+
+	layout, err := parseLayout(*layoutPtr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid -layout: %v\n\n", err)
+		flag.Usage()
+		os.Exit(1)
+	}
+	// -tree places the tree right before the files, unless -layout already places it
+	if *treePtr && !slices.Contains(layout, "tree") {
+		layout = slices.Insert(layout, max(slices.Index(layout, "files"), 0), "tree")
+	}
+
+	// Validate we have something to do
+	if len(argPaths) == 0 && len(examplePaths) == 0 && *gitRepoPtr == "" && *promptPtr == "" && *followUpFilePtr == "" && *promptTemplatePtr == "" && *commitsPtr == "" && len(commands) == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *gitRefPtr != "" && *gitRepoPtr == "" {
+		fmt.Fprintf(os.Stderr, "Error: -g-ref selects the ref of the -g repository and needs -g.\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *gitSubdirPtr != "" && *gitRepoPtr == "" {
+		fmt.Fprintf(os.Stderr, "Error: -g-subdir selects a directory of the -g repository and needs -g.\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *commitsPtr != "" && *atRevPtr != "" {
+		fmt.Fprintf(os.Stderr, "Error: -commits and -at-rev options are mutually exclusive.\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+	// Without explicit paths, -commits covers the whole repository of the current directory
+	if *commitsPtr != "" && len(argPaths) == 0 && *gitRepoPtr == "" {
+		argPaths = []string{"."}
+	}
+
+	// outputFiles are the absolute paths of the files fcopy writes, left out of directory walks and of the
+	// changes -watch reacts to
+	var outputFiles []string
+	outputPaths := []string{*outputFilePtr, *outputMarkdownPtr, *outputJSONPtr}
+	if *summaryJSONPtr != "-" {
+		outputPaths = append(outputPaths, *summaryJSONPtr)
+	}
+	if !slices.Contains([]string{"stdout", "stderr", "clipboard"}, *promptToPtr) {
+		outputPaths = append(outputPaths, *promptToPtr)
+	}
+	for _, path := range outputPaths {
+		if path == "" {
+			continue
+		}
+		if absPath, err := filepath.Abs(path); err == nil {
+			outputFiles = append(outputFiles, absPath)
+		}
+	}
+
+	if *watchPtr {
+		if *gitRepoPtr != "" || stdinConsumed || slices.Contains(argPaths, "-") {
+			fmt.Fprintf(os.Stderr, "Error: -watch needs local paths; it cannot be used with -g or stdin input.\n\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+		var roots []watchRoot
+		for _, argPath := range argPaths {
+			argPath, _ = splitTargetHeader(argPath)
+			argPath, _, _ = splitTargetSuffixes(argPath)
+			absPath, err := filepath.Abs(argPath)
+			if err != nil {
+				fatalf("Error getting absolute path for %s: %v", argPath, err)
+			}
+			info, err := os.Stat(absPath)
+			if err != nil {
+				fatalf("Error stating path %s: %v", argPath, err)
+			}
+			root := watchRoot{absPath: absPath, isDir: info.IsDir()}
+			if root.isDir {
+				for _, ignoreFile := range ignoreFiles {
+					root.excludes = append(root.excludes, readIgnoreFile(absPath, ignoreFile)...)
+				}
+			}
+			root.excludes = append(root.excludes, globalExcludePatterns...)
+			roots = append(roots, root)
+		}
+		ignored := make(map[string]bool)
+		for _, path := range outputFiles {
+			ignored[path] = true
+		}
+		watchAndRerun(roots, unignorePatterns, ignored, *includeHiddenPtr, hiddenAllowPatterns)
+		return
+	}
+
+	ctx := context.Background()
+	if *timeoutPtr > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeoutPtr)
+		defer cancel()
+	}
+
+	if *tokenizerPtr == "cl100k" {
+		var err error
+		if tokenizer, err = loadCl100k(ctx); err != nil {
+			fatalf("Error loading the cl100k tokenizer: %v", err)
+		}
+	}
+
+	var outputFormatter formatter = markdownFormatter{delimiter: unescapeDelimiter(*delimiterPtr)}
+	if *formatPtr == "xml" {
+		outputFormatter = xmlFormatter{}
+	}
+
+	p := &processor{
+		ctx:          ctx,
+		timeout:      *timeoutPtr,
+		stats:        newRunStats(),
+		stdinRead:    stdinConsumed,
+		stdinLang:    *stdinLangPtr,
+		blame:        *blamePtr,
+		formatter:    outputFormatter,
+		contentDepth: *contentDepthPtr,
+		failOnError:  *failOnErrorPtr,
+		showMode:     *showModePtr,
+		showLines:    *showLinesPtr,
+		dedupContent: *dedupContentPtr,
+		goOutline:    *goOutlinePtr,
+		excludeVCS:   *excludeVCSPtr,
+		groupByLang:  *groupByLangPtr,
+		sortBy:       *sortPtr,
+		sortReverse:  *sortReversePtr,
+		htmlMarkers:  *htmlMarkersPtr,
+		skipLocks:    !*includeLockfilesPtr,
+
+		pruneCommentsOnly: *pruneCommentsOnlyPtr,
+
+		gitMTime: *gitMTimePtr,
+		gitDates: make(map[string]map[string]string),
+		gitRoots: make(map[string]string),
+
+		filters: filters,
+
+		regionStart: *regionStartPtr,
+		regionEnd:   *regionEndPtr,
+		dedent:      *dedentPtr,
+
+		maxDirSize: maxDirSize,
+		dirSizes:   make(map[string]int64),
+		unignore:   unignorePatterns,
+		renames:    renames,
+
+		onlyDirsWith: *onlyDirsWithPtr,
+		markerDirs:   make(map[string]bool),
+
+		langOverrides: langOverrides,
+
+		ignoreFiles:    ignoreFiles,
+		globalExcludes: globalExcludePatterns,
+		includes:       includePatterns,
+
+		tokenReport: *tokenReportPtr,
+
+		followSymlinks: *followSymlinksPtr,
+		noEscape:       *noEscapePtr,
+
+		jobs: *jobsPtr,
+
+		includeHidden: *includeHiddenPtr,
+		hiddenAllow:   hiddenAllowPatterns,
+
+		maxSize:       maxSize,
+		maxBinarySize: maxBinarySize,
+		includeBinary: *includeBinaryPtr,
+
+		excludeContent:    excludeContent,
+		maxLineLength:     *maxLineLengthPtr,
+		truncateLongLines: *longLinesPtr == "truncate",
+
+		stripTrailingSpace: *stripTrailingSpacePtr,
+		lineNumbers:        *lineNumbersPtr,
+		dryRun:             *dryRunPtr,
+		expandTabs:         *expandTabsPtr,
+		editorConfigs:      make(map[string]*editorConfigFile),
+		repoMap:            *repoMapPtr,
+		maxMatches:         *maxMatchesPtr,
+		tests:              tests,
+	}
+	p.ownFiles = make(map[string]bool)
+	for _, path := range outputFiles {
+		p.ownFiles[path] = true
+	}
+	inputFiles := []string{*followUpFilePtr}
+	if strings.HasPrefix(*promptTemplatePtr, "@") {
+		inputFiles = append(inputFiles, strings.TrimPrefix(*promptTemplatePtr, "@"))
+	}
+	for _, inputFile := range inputFiles {
+		if inputFile == "" {
+			continue
+		}
+		if absInputFile, err := filepath.Abs(inputFile); err == nil {
+			p.ownFiles[absInputFile] = true
+		}
+	}
+
+	var targetsToProcess []target
+
+	// Handle Git Repository if -g is provided
+	if *gitRepoPtr != "" {
+		repoURL := *gitRepoPtr
+
+		// Without git, GitHub and GitLab repositories are downloaded as a tarball instead
+		_, gitErr := exec.LookPath("git")
+		archive, canDownload := archiveURL(repoURL, *gitRefPtr)
+		if gitErr != nil && !canDownload {
+			log.Fatal("Error: 'git' command not found in PATH. Required for -g flag with repositories not hosted on GitHub or GitLab.")
+		}
+
+		tempDir, err := os.MkdirTemp("", tempClonePattern)
+		if err != nil {
+			log.Fatalf("Error creating temporary directory: %v", err)
+		}
+		cleanups = append(cleanups, func() {
+			fmt.Fprintf(os.Stderr, "Cleaning up temp directory: %s\n", tempDir)
+			os.RemoveAll(tempDir)
+		})
+		defer runCleanups()
+
+		if gitErr != nil {
+			fmt.Fprintf(os.Stderr, "'git' not found, downloading %s into temporary directory...\n", archive)
+			if *gitSubmodulesPtr {
+				fmt.Fprintln(os.Stderr, "Warning: archives do not contain submodules, -g-submodules is ignored.")
+			}
+			if err := downloadArchive(ctx, archive, tempDir); err != nil {
+				p.checkTimeout()
+				if *gitRefPtr != "" {
+					fatalf("Error downloading repository at ref '%s' (does it exist?): %v", *gitRefPtr, err)
+				}
+				fatalf("Error downloading repository: %v", err)
+			}
+		} else if err := cloneRepository(ctx, repoURL, tempDir, *gitRefPtr, *gitQuietPtr, *gitSubmodulesPtr); err != nil {
+			p.checkTimeout()
+			if *gitRefPtr != "" {
+				fatalf("Error cloning repository at ref '%s' (does it exist?): %v", *gitRefPtr, err)
+			}
+			fatalf("Error cloning repository: %v", err)
+		}
+
+		repoName := getRepoName(repoURL)
+		cloneTarget := target{absPath: tempDir, displayBase: repoName, isDir: true}
+		if *gitSubdirPtr != "" {
+			subdir := filepath.Clean(filepath.FromSlash(strings.Trim(*gitSubdirPtr, "/")))
+			if subdir == "." || !filepath.IsLocal(subdir) {
+				fatalf("Error: -g-subdir must be a relative path inside the repository, got '%s'", *gitSubdirPtr)
+			}
+			cloneTarget.absPath = filepath.Join(tempDir, subdir)
+			cloneTarget.displayBase = repoName + "/" + filepath.ToSlash(subdir)
+			if info, err := os.Stat(cloneTarget.absPath); err != nil || !info.IsDir() {
+				fatalf("Error: -g-subdir '%s' is not a directory of %s", *gitSubdirPtr, repoURL)
+			}
+		}
+		targetsToProcess = append(targetsToProcess, cloneTarget)
+	}
+	// Handle standard positional arguments
+	for _, argPath := range argPaths {
+		argPath, header := splitTargetHeader(argPath)
+
+		// A lone "-" reads content from stdin, kept in argument order with the other targets
+		if argPath == "-" {
+			targetsToProcess = append(targetsToProcess, target{displayBase: *stdinNamePtr, isStdin: true, header: header})
+			continue
+		}
+
+		argPath, mode, lang := splitTargetSuffixes(argPath)
+		if mode == "" && *diffPtr {
+			mode = "diff"
+		}
+
+		absPath, err := filepath.Abs(argPath)
+		if err != nil {
+			p.reportError("Error getting absolute path for %s: %v", argPath, err)
+			continue
+		}
+
+		info, err := os.Stat(absPath)
+		if err != nil {
+			p.reportError("Error stating path %s: %v", argPath, err)
+			continue
+		}
+		if lang != "" {
+			p.langOverrides[absPath] = lang
+		}
 
 		var displayBase string
 		if filepath.IsAbs(argPath) {
@@ -273,66 +1533,171 @@ func main() {
 		} else {
 			displayBase = argPath
 		}
+		if *stripTempPtr {
+			displayBase = stripTempPrefix(displayBase)
+		}
 
 		targetsToProcess = append(targetsToProcess, target{
 			absPath:     absPath,
 			displayBase: displayBase,
 			isDir:       info.IsDir(),
+			mode:        mode,
+			header:      header,
 		})
 	}
 
 	// Process all targets
 	for _, t := range targetsToProcess {
-		// Create a specific list of excludes for this target, starting with the globals
-		targetExcludes := make([]string, len(globalExcludePatterns))
-		copy(targetExcludes, globalExcludePatterns)
-
-		// If it's a directory, look for a .gitignore file at the root of that target
+		// Create a specific list of excludes for this target: if it's a directory, the patterns
+		// of the ignore files at its root, then the globals, so a '!' line in an ignore file
+		// cannot re-include what -x excludes
+		var targetExcludes []string
 		if t.isDir {
-			gitIgnorePatterns := readGitIgnore(t.absPath)
-			if len(gitIgnorePatterns) > 0 {
-				fmt.Fprintf(os.Stderr, "Detected .gitignore in %s, adding %d patterns.\n", t.displayBase, len(gitIgnorePatterns))
-				targetExcludes = append(targetExcludes, gitIgnorePatterns...)
+			for _, ignoreFile := range ignoreFiles {
+				ignorePatterns := readIgnoreFile(t.absPath, ignoreFile)
+				if len(ignorePatterns) > 0 {
+					fmt.Fprintf(os.Stderr, "Detected %s in %s, adding %d patterns.\n", ignoreFile, t.displayBase, len(ignorePatterns))
+					targetExcludes = append(targetExcludes, ignorePatterns...)
+				}
 			}
 		}
+		targetExcludes = append(targetExcludes, globalExcludePatterns...)
 
 		// Pre-check exclude for the root path itself
 		if !strings.HasPrefix(t.absPath, os.TempDir()) {
-			if excluded, pattern := isExcluded(filepath.ToSlash(filepath.Clean(t.displayBase)), targetExcludes); excluded {
+			if excluded, pattern := p.isExcluded(filepath.ToSlash(filepath.Clean(t.displayBase)), targetExcludes); excluded {
 				fmt.Fprintf(os.Stderr, "Skipping path %s (matches exclude pattern '%s')\n", t.displayBase, pattern)
+				p.stats.skip(skipExcluded, filepath.ToSlash(t.displayBase))
 				continue
 			}
 		}
 
-		if t.isDir {
-			processDirectory(t.absPath, t.displayBase, &outputBuilder, targetExcludes)
+		if *applyIgnoreToArgsPtr && !t.isDir && !t.isStdin {
+			if ignored, ignoreFile, pattern := p.ignoredByAncestors(t.absPath, ignoreFiles); ignored {
+				fmt.Fprintf(os.Stderr, "Skipping path %s (matches pattern '%s' in %s)\n", t.displayBase, pattern, ignoreFile)
+				p.stats.skip(skipExcluded, filepath.ToSlash(t.displayBase))
+				continue
+			}
+		}
+
+		start := len(p.blocks)
+		if t.isStdin {
+			p.processStdin(t.displayBase)
+		} else if *commitsPtr != "" {
+			p.processCommits(t, *commitsPtr)
+		} else if *atRevPtr != "" {
+			p.processRevision(t, *atRevPtr, targetExcludes)
+		} else if t.mode == "diff" {
+			p.processDiff(t, targetExcludes)
+		} else {
+			blame := p.blame
+			p.blame = blame || t.mode == "blame"
+			if t.isDir {
+				p.processDirectory(t.absPath, t.displayBase, targetExcludes)
+			} else {
+				p.processFile(t.absPath, t.displayBase)
+			}
+			p.blame = blame
+		}
+		if t.header != "" {
+			p.addTargetHeader(start, t.header)
+		}
+		p.checkTimeout()
+	}
+
+	if *dryRunPtr {
+		printDryRun(os.Stdout, p.dryRunFiles, p.stats, p.renameDisplay)
+		return
+	}
+
+	if len(p.repoMapEntries) > 0 {
+		p.blocks = append(p.blocks, outputBlock{
+			title:   fmt.Sprintf("repo map (%d files)", len(p.repoMapEntries)),
+			content: []byte(renderRepoMap(p.repoMapEntries)),
+		})
+	}
+
+	if *pathsOnlyPtr {
+		separator := "\n"
+		if *nullPtr {
+			separator = "\x00"
+		}
+		out := bufio.NewWriter(os.Stdout)
+		for _, path := range p.included {
+			out.WriteString(p.renameDisplay(path) + separator)
+		}
+		if err := out.Flush(); err != nil {
+			fatalf("Error writing paths: %v", err)
+		}
+		return
+	}
+
+	// Fold the output of -cmd commands in after the targets
+	for _, command := range commands {
+		p.processCommand(command, *cmdTimeoutPtr)
+		p.checkTimeout()
+	}
+
+	sections := promptSections{files: p.render()}
+	var treeBlock outputBlock
+	if treeFiles := slices.Concat(p.included, p.listed); len(treeFiles) > 0 {
+		renamed := make([]string, len(treeFiles))
+		for i, path := range treeFiles {
+			renamed[i] = p.renameDisplay(path)
+		}
+		sections.tree = renderTree(".", renamed)
+		if *treePtr {
+			treeBlock = outputBlock{lang: "text", title: "file tree", content: []byte(sections.tree)}
+			sections.tree = p.formatter.block(treeBlock)
+		}
+	}
+
+	// Few-shot examples are collected apart from the targets, so -layout can place them on their own
+	examples := p.withEmptyOutput()
+	for _, examplePath := range examplePaths {
+		absPath, err := filepath.Abs(examplePath)
+		if err != nil {
+			p.reportError("Error getting absolute path for -examples %s: %v", examplePath, err)
+			continue
+		}
+		info, err := os.Stat(absPath)
+		if err != nil {
+			p.reportError("Error stating -examples path %s: %v", examplePath, err)
+			continue
+		}
+		if info.IsDir() {
+			var excludes []string
+			for _, ignoreFile := range ignoreFiles {
+				excludes = append(excludes, readIgnoreFile(absPath, ignoreFile)...)
+			}
+			excludes = append(excludes, globalExcludePatterns...)
+			examples.processDirectory(absPath, examplePath, excludes)
 		} else {
-			processFile(t.absPath, t.displayBase, &outputBuilder)
+			examples.processFile(absPath, examplePath)
 		}
 	}
+	sections.examples = examples.render()
 
 	// Append the prompt from -p if provided
 	promptText := *promptPtr
 	if promptText != "" {
-		if outputBuilder.Len() > 0 {
-			outputBuilder.WriteString("\n\n")
-		}
-		outputBuilder.WriteString(promptText)
+		sections.prompt = promptText
 		fmt.Fprintf(os.Stderr, "Appended prompt text.\n")
 	}
 
 	// Append content from the -f file if provided
+	followUp := p.withEmptyOutput()
 	followUpFilePath := *followUpFilePtr
 	if followUpFilePath != "" {
 		absFollowUpPath, err := filepath.Abs(followUpFilePath)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error getting absolute path for follow-up file -f %s: %v\n", followUpFilePath, err)
+			p.reportError("Error getting absolute path for follow-up file -f %s: %v", followUpFilePath, err)
 		} else {
 			info, err := os.Stat(absFollowUpPath)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error stating follow-up file -f %s: %v\n", followUpFilePath, err)
+				p.reportError("Error stating follow-up file -f %s: %v", followUpFilePath, err)
 			} else if info.IsDir() {
-				fmt.Fprintf(os.Stderr, "Error: Path for -f (%s) is a directory, must be a file.\n", followUpFilePath)
+				p.reportError("Error: Path for -f (%s) is a directory, must be a file.", followUpFilePath)
 			} else {
 				var displayFollowUpPath string
 				if filepath.IsAbs(followUpFilePath) {
@@ -341,110 +1706,254 @@ func main() {
 					displayFollowUpPath = followUpFilePath
 				}
 
-				if outputBuilder.Len() > 0 {
-					outputBuilder.WriteString("\n\n")
+				followUp.processFile(absFollowUpPath, displayFollowUpPath)
+				sections.followUp = followUp.render()
+			}
+		}
+	}
+
+	// With -prompt-to, the prompt and the -f file leave the main output for their own sink
+	var promptOutput string
+	if *promptToPtr != "" {
+		promptOutput = promptSections{prompt: sections.prompt, followUp: sections.followUp}.join([]string{"prompt", "followup"})
+		sections.prompt, sections.followUp = "", ""
+		followUp = p.withEmptyOutput()
+	}
+
+	finalOutput := sections.join(layout)
+	if promptTemplate != "" {
+		finalOutput = sections.renderTemplate(promptTemplate)
+	}
+
+	// Every format is rendered from the same collected blocks, so -o-markdown and -o-json
+	// can write extra copies of the output next to the main one
+	renderJSONOutput := func() string {
+		jsonOutput, err := renderJSON(slices.Concat(examples.outputBlocks(), p.outputBlocks(), followUp.outputBlocks()))
+		if err != nil {
+			fatalf("Error encoding JSON output: %v", err)
+		}
+		return jsonOutput
+	}
+	var extraOutputs [][2]string // path, content
+	if *outputMarkdownPtr != "" {
+		markdownOutput := finalOutput
+		if *formatPtr == "xml" {
+			markdown := markdownFormatter{delimiter: unescapeDelimiter(*delimiterPtr)}
+			markdownSections := sections
+			markdownSections.files = p.renderWith(markdown)
+			markdownSections.examples = examples.renderWith(markdown)
+			if markdownSections.followUp != "" {
+				markdownSections.followUp = followUp.renderWith(markdown)
+			}
+			if *treePtr && markdownSections.tree != "" {
+				markdownSections.tree = markdown.block(treeBlock)
+			}
+			markdownOutput = markdownSections.join(layout)
+			if promptTemplate != "" {
+				markdownOutput = markdownSections.renderTemplate(promptTemplate)
+			}
+		}
+		extraOutputs = append(extraOutputs, [2]string{*outputMarkdownPtr, markdownOutput})
+	}
+	if *outputJSONPtr != "" {
+		extraOutputs = append(extraOutputs, [2]string{*outputJSONPtr, renderJSONOutput()})
+	}
+
+	if *formatPtr == "json" {
+		if promptText != "" || promptTemplate != "" {
+			fmt.Fprintln(os.Stderr, "Warning: -p and -prompt-template are ignored with -format json.")
+		}
+		finalOutput = renderJSONOutput()
+	}
+
+	if *noTrailingNewlinePtr {
+		finalOutput = strings.TrimRight(finalOutput, "\r\n")
+		for i := range extraOutputs {
+			extraOutputs[i][1] = strings.TrimRight(extraOutputs[i][1], "\r\n")
+		}
+	}
+
+	var chunks []int
+	if *chunkTokensPtr > 0 && *formatPtr != "json" {
+		// Chunks are split at block boundaries, following the section order of -layout
+		var pieces []string
+		for _, name := range layout {
+			switch name {
+			case "examples":
+				for _, block := range examples.outputBlocks() {
+					pieces = append(pieces, p.formatter.block(block))
 				}
-				processFile(absFollowUpPath, displayFollowUpPath, &outputBuilder)
+			case "files":
+				for _, block := range p.outputBlocks() {
+					pieces = append(pieces, p.formatter.block(block))
+				}
+			case "followup":
+				for _, block := range followUp.outputBlocks() {
+					pieces = append(pieces, p.formatter.block(block))
+				}
+			default:
+				if section, _ := sections.section(name); section != "" {
+					pieces = append(pieces, section)
+				}
+			}
+		}
+		chunks = planChunks(pieces, *chunkTokensPtr)
+		fmt.Fprintf(os.Stderr, "Content splits into %d chunk(s) of up to %d tokens at file boundaries:\n", len(chunks), *chunkTokensPtr)
+		for i, tokens := range chunks {
+			over := ""
+			if tokens > *chunkTokensPtr {
+				over = " (a single block over the limit)"
 			}
+			fmt.Fprintf(os.Stderr, "  chunk %d: ~%d tokens%s\n", i+1, tokens, over)
 		}
 	}
 
-	finalOutput := outputBuilder.String()
+	printSkipSummary(os.Stderr, p.stats, p.renameDisplay)
 
+	var tokenCount int
+	var cost float64
 	if strings.TrimSpace(finalOutput) == "" {
 		fmt.Fprintln(os.Stderr, "Warning: Output is empty or contains only whitespace.")
 	} else {
-		_, details := estimateTokens(finalOutput)
-		fmt.Fprintf(os.Stderr, "Estimated token count: %s\n", details)
+		var details string
+		if tokenizer != nil {
+			tokenCount = tokenizer.count(finalOutput)
+			fmt.Fprintf(os.Stderr, "Token count (%s): %d tokens\n", tokenizer.name, tokenCount)
+		} else {
+			tokenCount, details = estimateTokens(finalOutput)
+			fmt.Fprintf(os.Stderr, "Estimated token count: %s\n", details)
+		}
+		if pricePerMTok > 0 {
+			cost = float64(tokenCount) * pricePerMTok / 1e6
+			model := *costPtr
+			if model == "" {
+				model = "the given price"
+			}
+			fmt.Fprintf(os.Stderr, "Estimated input cost for %s: $%.4f (at $%.2f per million tokens)\n", model, cost, pricePerMTok)
+		}
+		if contextWindow > 0 {
+			checkContextWindow(os.Stderr, *modelPtr, contextWindow, tokenCount)
+		}
+		if *tokenReportPtr > 0 {
+			printTokenReport(os.Stderr, slices.Concat(examples.outputBlocks(), p.outputBlocks(), followUp.outputBlocks()), tokenCount, *tokenReportPtr)
+		}
+	}
+
+	if *base64OutPtr && finalOutput != "" {
+		finalOutput = encodeBase64Output(finalOutput)
+		fmt.Fprintln(os.Stderr, "Output is base64-encoded; the token estimate above is for the decoded content.")
 	}
 
-	// Output handling
+	// Output handling: -s and -o can be combined, and the clipboard is used when neither is given or with -c
+	var backends []string
 	if *stdoutPtr {
 		fmt.Print(finalOutput)
 		fmt.Fprintln(os.Stderr, "Content written to stdout.")
-	} else if *outputFilePtr != "" {
+		backends = append(backends, "stdout")
+	}
+	if *outputFilePtr != "" {
 		filePath := *outputFilePtr
 		err := os.WriteFile(filePath, []byte(finalOutput), 0644)
 		if err != nil {
-			log.Fatalf("Failed to write to output file %s: %v", filePath, err)
+			fatalf("Failed to write to output file %s: %v", filePath, err)
 		}
 		fmt.Fprintf(os.Stderr, "Content written to file: %s\n", filePath)
-	} else {
-		copyToClipboard(finalOutput, *termCopyPtr)
+		backends = append(backends, "file")
 	}
-}
-
-// copyToClipboard handles the logic of copying text to the system clipboard
-func copyToClipboard(content string, useTermAware bool) {
-	if strings.TrimSpace(content) == "" {
-		fmt.Fprintln(os.Stderr, "No content to copy to clipboard.")
-		return
+	for _, output := range extraOutputs {
+		if err := os.WriteFile(output[0], []byte(output[1]), 0644); err != nil {
+			fatalf("Failed to write to output file %s: %v", output[0], err)
+		}
+		fmt.Fprintf(os.Stderr, "Content written to file: %s\n", output[0])
+		if !slices.Contains(backends, "file") {
+			backends = append(backends, "file")
+		}
 	}
-
-	if useTermAware {
-		term := os.Getenv("TERM")
-		if strings.Contains(term, "kitty") || strings.Contains(term, "xterm") || os.Getenv("TMUX") != "" {
-			fmt.Fprintln(os.Stderr, "Attempting clipboard copy via OSC 52 escape code...")
-			encodedContent := base64.StdEncoding.EncodeToString([]byte(content))
-			if os.Getenv("TMUX") != "" {
-				fmt.Printf("\x1bPtmux;\x1b\x1b]52;c;%s\x07\x1b\\", encodedContent)
-			} else {
-				fmt.Printf("\x1b]52;c;%s\x07", encodedContent)
+	if len(backends) == 0 || *clipboardPtr {
+		var backend string
+		if *clipFormatPtr == "html" && strings.TrimSpace(finalOutput) != "" {
+			if backend = copyHTMLToClipboard(finalOutput); backend == "" {
+				fmt.Fprintln(os.Stderr, "No HTML-capable clipboard tool found, falling back to plain text.")
+				backend = copyToClipboard(finalOutput, *termCopyPtr, *clipRetriesPtr)
 			}
-			fmt.Fprintln(os.Stderr, "Content sent to terminal for clipboard (OSC 52).")
-			return
+		} else {
+			backend = copyToClipboard(finalOutput, *termCopyPtr, *clipRetriesPtr)
+		}
+		if backend != "" {
+			backends = append(backends, backend)
 		}
 	}
-
-	if os.Getenv("KITTY_WINDOW_ID") != "" {
-		kittyPath, err := exec.LookPath("kitty")
-		if err == nil {
-			fmt.Fprintln(os.Stderr, "Attempting clipboard copy via `kitty +kitten clipboard`...")
-			cmd := exec.Command(kittyPath, "+kitten", "clipboard")
-			cmd.Stdin = strings.NewReader(content)
-			cmd.Stderr = os.Stderr
-			if err := cmd.Run(); err == nil {
-				fmt.Fprintln(os.Stderr, "Content copied to clipboard via `kitty +kitten clipboard`.")
-				return
+	backend := strings.Join(backends, "+")
+
+	if promptOutput != "" {
+		switch *promptToPtr {
+		case "stdout":
+			fmt.Print(promptOutput + "\n")
+		case "stderr":
+			fmt.Fprint(os.Stderr, promptOutput+"\n")
+		case "clipboard":
+			copyToClipboard(promptOutput, *termCopyPtr, *clipRetriesPtr)
+		default:
+			if err := os.WriteFile(*promptToPtr, []byte(promptOutput+"\n"), 0644); err != nil {
+				fatalf("Failed to write the prompt to %s: %v", *promptToPtr, err)
 			}
 		}
+		fmt.Fprintf(os.Stderr, "Prompt written to %s.\n", *promptToPtr)
 	}
 
-	tools := []string{"wl-copy", "xclip -selection clipboard", "xsel --clipboard"}
-	for _, tool := range tools {
-		parts := strings.Fields(tool)
-		path, err := exec.LookPath(parts[0])
-		if err != nil {
-			continue
+	if *summaryJSONPtr != "" {
+		if err := writeSummaryJSON(*summaryJSONPtr, p.stats, len(finalOutput), tokenCount, cost, chunks, backend); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing summary JSON: %v\n", err)
 		}
+	}
+}
 
-		fmt.Fprintf(os.Stderr, "Attempting clipboard copy via `%s`...\n", tool)
-		cmd := exec.Command(path, parts[1:]...)
-		cmd.Stdin = strings.NewReader(content)
-		cmd.Stderr = os.Stderr
+// maxWalkDepth is the directory depth below a target past which a walk is considered pathological.
+const maxWalkDepth = 50
 
-		if err := cmd.Run(); err == nil {
-			fmt.Fprintf(os.Stderr, "Content copied to clipboard via `%s`.\n", tool)
-			return
-		} else {
-			fmt.Fprintf(os.Stderr, "Failed to copy with `%s`: %v\n", tool, err)
-		}
+// processDirectory walks a directory and processes all files within it.
+func (p *processor) processDirectory(absDirPath string, baseDisplayPath string, excludePatterns []string) {
+	fmt.Fprintf(os.Stderr, "Processing directory: %s\n", baseDisplayPath)
+
+	// With -content-depth, files past the depth limit are only listed, while the
+	// included files are remembered so the tree shows the full structure.
+	var treePaths []string
+	omitted := 0
+
+	// The walk only collects the files to process, which are then read concurrently and processed in walk order.
+	// listOnly files are past -content-depth and only shown in the tree.
+	type walkFile struct {
+		absPath      string
+		relativePath string
+		displayPath  string
+		listOnly     bool
 	}
+	var files []walkFile
+
+	// The ignore files of subdirectories apply below them only: scoped maps each directory, relative
+	// to absDirPath, to the patterns of the ignore files found in it and its parents, made relative to
+	// absDirPath. Those of absDirPath itself are already in excludePatterns.
+	scoped := make(map[string][]string)
 
-	fmt.Fprintln(os.Stderr, "Falling back to default clipboard library (may not work over SSH)...")
-	if err := clipboard.Init(); err != nil {
-		log.Fatalf("Failed to initialize clipboard library: %v\nPlease install xclip/xsel or wl-clipboard, or use -t.", err)
+	// With -follow-symlinks, a symlinked directory is walked at its real path, its entries keeping their
+	// paths below the link. visited holds the real paths of the directories entered so far, so a symlink loop
+	// is not followed.
+	realRoot, err := filepath.EvalSymlinks(absDirPath)
+	if err != nil {
+		realRoot = absDirPath
 	}
-	clipboard.Write(clipboard.FmtText, []byte(content))
-	fmt.Fprintln(os.Stderr, "Content copied to clipboard!")
-}
+	visited := map[string]bool{realRoot: true}
+	var walk func(root string, linkPath string)
 
-// processDirectory walks a directory and processes all files within it.
-func processDirectory(absDirPath string, baseDisplayPath string, builder *strings.Builder, excludePatterns []string) {
-	fmt.Fprintf(os.Stderr, "Processing directory: %s\n", baseDisplayPath)
-	filepath.WalkDir(absDirPath, func(currentAbsPath string, d fs.DirEntry, errWalk error) error {
+	visit := func(currentAbsPath string, d fs.DirEntry, errWalk error) error {
+		if err := p.ctx.Err(); err != nil {
+			return err
+		}
+		if p.matchLimitHit {
+			return filepath.SkipAll
+		}
 		if errWalk != nil {
-			fmt.Fprintf(os.Stderr, "Error accessing %s: %v\n", currentAbsPath, errWalk)
+			p.reportError("Error accessing %s: %v", currentAbsPath, errWalk)
 			if d == nil {
 				return errWalk
 			}
@@ -459,90 +1968,1237 @@ func processDirectory(absDirPath string, baseDisplayPath string, builder *string
 		// Calculate relative path for all subsequent checks
 		relativePath, err := filepath.Rel(absDirPath, currentAbsPath)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error calculating relative path: %v. Skipping.\n", err)
+			p.reportError("Error calculating relative path: %v. Skipping.", err)
 			return nil
 		}
+		displayPath := filepath.ToSlash(filepath.Join(baseDisplayPath, relativePath))
+
+		// Symlinked files are read as their targets. With -no-escape, symlinks resolving outside the target are
+		// skipped, and with -follow-symlinks, symlinked directories are checked like directories and walked.
+		isDir, linkTarget := d.IsDir(), ""
+		if d.Type()&fs.ModeSymlink != 0 && (p.followSymlinks || p.noEscape) {
+			if realPath, err := filepath.EvalSymlinks(currentAbsPath); err == nil {
+				if p.noEscape && !withinDir(realRoot, realPath) {
+					fmt.Fprintf(os.Stderr, "Warning: skipping symlink %s: it points outside the target, to %s\n", relativePath, realPath)
+					p.stats.skip(skipSymlinkEscape, displayPath)
+					return nil
+				}
+				if info, err := os.Stat(realPath); err == nil && info.IsDir() && p.followSymlinks {
+					isDir, linkTarget = true, realPath
+				}
+			}
+		}
+		// Returning SkipDir for a symlink would skip the rest of its parent directory instead
+		skipDir := filepath.SkipDir
+		if linkTarget != "" {
+			skipDir = nil
+		}
+
+		// VCS metadata is never useful context, so it is pruned silently before any other check
+		if isDir && p.excludeVCS && vcsDirNames[d.Name()] {
+			return skipDir
+		}
 
 		// Check against user-defined exclude patterns
-		if excluded, pattern := isExcluded(relativePath, excludePatterns); excluded {
-			if d.Name() != ".git" {
+		patterns := excludePatterns
+		if nested := scoped[filepath.Dir(relativePath)]; len(nested) > 0 {
+			patterns = slices.Concat(excludePatterns, nested, p.globalExcludes)
+		}
+		if excluded, pattern := p.isExcluded(relativePath, patterns); excluded {
+			if !vcsDirNames[d.Name()] {
 				fmt.Fprintf(os.Stderr, "Skipping excluded path: %s (pattern: '%s')\n", relativePath, pattern)
+				p.stats.skip(skipExcluded, displayPath)
 			}
-			if d.IsDir() {
-				return filepath.SkipDir
+			if isDir {
+				return skipDir
 			}
 			return nil
 		}
 
 		// Handle directories (check for hidden ones)
-		if d.IsDir() {
-			if strings.HasPrefix(d.Name(), ".") && d.Name() != "." && d.Name() != ".." {
-				if d.Name() != ".git" {
+		if isDir {
+			if hiddenSkipped(relativePath, p.includeHidden, p.hiddenAllow) {
+				if !vcsDirNames[d.Name()] {
 					fmt.Fprintf(os.Stderr, "Skipping hidden directory: %s\n", relativePath)
+					p.stats.skip(skipHidden, displayPath)
+				}
+				return skipDir
+			}
+			if depth := strings.Count(filepath.ToSlash(relativePath), "/") + 1; depth > maxWalkDepth {
+				p.reportError("Error: %s is %d directories deep, which usually means a symlink loop or a mistaken target; not descending further", currentAbsPath, depth)
+				return skipDir
+			}
+			if p.maxDirSize > 0 {
+				if size := p.dirSize(currentAbsPath); size > p.maxDirSize {
+					fmt.Fprintf(os.Stderr, "Warning: skipping directory %s: %s exceeds -max-dir-size\n", relativePath, formatSize(int(size)))
+					p.stats.skip(skipDirTooLarge, displayPath)
+					return skipDir
 				}
-				return filepath.SkipDir
+			}
+
+			// With -follow-symlinks, every directory is recorded by real path when entered, so one reached again,
+			// through a link back into the tree or a second link, is not walked twice
+			if p.followSymlinks {
+				realPath := linkTarget
+				if realPath == "" {
+					if realPath, err = filepath.EvalSymlinks(currentAbsPath); err != nil {
+						realPath = currentAbsPath
+					}
+				}
+				if visited[realPath] {
+					fmt.Fprintf(os.Stderr, "Warning: not walking %s: %s is already walked (symlink loop or duplicate link)\n", relativePath, realPath)
+					return skipDir
+				}
+				visited[realPath] = true
+			}
+
+			nested := scoped[filepath.Dir(relativePath)]
+			for _, ignoreFile := range p.ignoreFiles {
+				if ignorePatterns := readIgnoreFile(currentAbsPath, ignoreFile); len(ignorePatterns) > 0 {
+					fmt.Fprintf(os.Stderr, "Detected %s in %s, adding %d patterns for its subtree.\n", ignoreFile, relativePath, len(ignorePatterns))
+					nested = slices.Concat(nested, scopeIgnorePatterns(filepath.ToSlash(relativePath), ignorePatterns))
+				}
+			}
+			if len(nested) > 0 {
+				scoped[relativePath] = nested
+			}
+
+			if linkTarget != "" {
+				fmt.Fprintf(os.Stderr, "Following symlink %s to %s\n", relativePath, linkTarget)
+				walk(linkTarget, currentAbsPath)
 			}
 			return nil
 		}
 
 		// Handle files
-		if strings.HasPrefix(d.Name(), ".") {
+		if hiddenSkipped(relativePath, p.includeHidden, p.hiddenAllow) {
 			fmt.Fprintf(os.Stderr, "Skipping hidden file: %s\n", relativePath)
+			p.stats.skip(skipHidden, displayPath)
+			return nil
+		}
+
+		if !p.isIncluded(relativePath) {
+			fmt.Fprintf(os.Stderr, "Skipping %s: matches no include pattern\n", relativePath)
+			p.stats.skip(skipNotIncluded, displayPath)
+			return nil
+		}
+
+		if p.ownFiles[currentAbsPath] {
+			fmt.Fprintf(os.Stderr, "Skipping fcopy's own input/output file: %s\n", relativePath)
+			p.stats.skip(skipExcluded, displayPath)
+			return nil
+		}
+
+		if p.onlyDirsWith != "" && !p.dirHasMatch(filepath.Dir(currentAbsPath)) {
+			fmt.Fprintf(os.Stderr, "Skipping %s: its directory has no file matching '%s'\n", relativePath, p.onlyDirsWith)
+			p.stats.skip(skipOnlyDirsWith, displayPath)
+			return nil
+		}
+
+		if skip, reason := p.testSkipped(relativePath); skip {
+			fmt.Fprintf(os.Stderr, "Skipping %s: %s\n", relativePath, reason)
+			p.stats.skip(reason, displayPath)
+			return nil
+		}
+
+		if p.skipLocks && lockFiles[strings.ToLower(d.Name())] {
+			fmt.Fprintf(os.Stderr, "Skipping lock file: %s (use -include-lockfiles to keep it)\n", relativePath)
+			p.stats.skip(skipLockFile, displayPath)
 			return nil
 		}
 
-		displayFilePath := filepath.ToSlash(filepath.Join(baseDisplayPath, relativePath))
-		processFile(currentAbsPath, displayFilePath, builder)
+		files = append(files, walkFile{
+			absPath:      currentAbsPath,
+			relativePath: relativePath,
+			displayPath:  displayPath,
+			listOnly:     p.contentDepth > 0 && strings.Count(filepath.ToSlash(relativePath), "/")+1 > p.contentDepth,
+		})
 		return nil
-	})
+	}
+
+	// walk walks root, passing visit the paths of its entries as if root were at linkPath.
+	// The root itself has already been checked, as the walked directory or as a symlink entry.
+	walk = func(root string, linkPath string) {
+		filepath.WalkDir(root, func(path string, d fs.DirEntry, errWalk error) error {
+			if path == root && errWalk == nil {
+				return nil
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			return visit(filepath.Join(linkPath, rel), d, errWalk)
+		})
+	}
+	// A symlink given as the target is only descended into with -follow-symlinks, like those found while walking
+	if p.followSymlinks {
+		walk(realRoot, absDirPath)
+	} else {
+		walk(absDirPath, absDirPath)
+	}
+
+	// With -blame the content comes from git blame rather than the file, and -dry-run doesn't read files
+	// whole, so nothing is read ahead
+	read := readFile
+	if !p.blame && !p.dryRun {
+		var paths []string
+		for _, file := range files {
+			if !file.listOnly {
+				paths = append(paths, file.absPath)
+			}
+		}
+		ahead := startReadAhead(paths, p.jobs, p.readLimit())
+		defer ahead.stop()
+		next := 0
+		read = func(string) fileContent {
+			file := ahead.next(next)
+			next++
+			return file
+		}
+	}
+
+	for _, file := range files {
+		if p.ctx.Err() != nil || p.matchLimitHit {
+			break
+		}
+		if file.listOnly {
+			treePaths = append(treePaths, filepath.ToSlash(file.relativePath))
+			p.listed = append(p.listed, file.displayPath)
+			omitted++
+			continue
+		}
+		if p.processFileWith(file.absPath, file.displayPath, read) && p.contentDepth > 0 {
+			treePaths = append(treePaths, filepath.ToSlash(file.relativePath))
+		}
+	}
+
+	if omitted > 0 {
+		fmt.Fprintf(os.Stderr, "Listing %d file(s) deeper than %d level(s) in a tree: %s\n", omitted, p.contentDepth, baseDisplayPath)
+		header := fmt.Sprintf("%s (tree, contents deeper than %d level(s) omitted)", filepath.ToSlash(baseDisplayPath), p.contentDepth)
+		p.blocks = append(p.blocks, outputBlock{
+			lang:    "text",
+			title:   header,
+			content: []byte(renderTree(p.renameDisplay(filepath.ToSlash(baseDisplayPath)), treePaths)),
+		})
+	}
 }
 
-// processFile reads a file and appends its content formatted as a markdown code block to the builder.
-func processFile(absFilePath string, displayFilePath string, builder *strings.Builder) {
-	content, err := os.ReadFile(absFilePath)
+// withinDir reports whether path is dir or one of its descendants, both being absolute paths.
+func withinDir(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// processCommand runs a -cmd value through the shell and adds its stdout as a block.
+// The value is either a bare command, shown as "$ command", or "header:::command" to choose the header.
+func (p *processor) processCommand(value string, timeout time.Duration) {
+	header, command, found := strings.Cut(value, ":::")
+	if !found {
+		command = value
+		header = "$ " + value
+	}
+	header, command = strings.TrimSpace(header), strings.TrimSpace(command)
+
+	ctx := p.ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	cmd.Stderr = os.Stderr
+
+	fmt.Fprintf(os.Stderr, "Running command: %s\n", command)
+	out, err := cmd.Output()
+
+	var notes []string
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading file %s: %v\n", displayFilePath, err)
-		return
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) && p.ctx.Err() == nil {
+			p.reportError("Error: command `%s` timed out after %s", command, timeout)
+			return
+		}
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			p.reportError("Error running command `%s`: %v", command, err)
+			return
+		}
+		p.reportError("Warning: command `%s` exited with status %d", command, exitErr.ExitCode())
+		notes = append(notes, fmt.Sprintf("exit status %d", exitErr.ExitCode()))
 	}
 
-	if len(content) > 1*1024*1024 {
-		fmt.Fprintf(os.Stderr, "Skipping large file (> 1MB): %s\n", displayFilePath)
-		return
+	fmt.Fprintf(os.Stderr, "Adding command output: %s\n", header)
+	p.blocks = append(p.blocks, outputBlock{
+		lang:    "text",
+		title:   header,
+		notes:   notes,
+		content: out,
+	})
+}
+
+// runFilter pipes content through a -filter shell command and returns its stdout. The command gets the
+// display path in FCOPY_PATH, and as "$1" with sh, and the absolute path, if any, in FCOPY_ABS_PATH.
+func (p *processor) runFilter(filter string, content []byte, absFilePath string, displayFilePath string) ([]byte, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(p.ctx, "cmd", "/C", filter)
+	} else {
+		cmd = exec.CommandContext(p.ctx, "sh", "-c", filter, "fcopy-filter", displayFilePath)
 	}
+	cmd.Env = append(os.Environ(), "FCOPY_PATH="+displayFilePath, "FCOPY_ABS_PATH="+absFilePath)
+	cmd.Stdin = bytes.NewReader(content)
+	cmd.Stderr = os.Stderr
+	return cmd.Output()
+}
 
-	isBinary := false
-	for i, b := range content {
-		if b == 0 {
-			if i < 10 && (len(content) > i+1 && content[i+1] == 0) {
-				continue
+// processStdin reads all of standard input and adds it as a single block.
+func (p *processor) processStdin(displayPath string) bool {
+	if p.stdinRead {
+		fmt.Fprintln(os.Stderr, "Skipping repeated '-': stdin has already been read.")
+		return false
+	}
+	p.stdinRead = true
+
+	content, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		p.reportError("Error reading stdin: %v", err)
+		return false
+	}
+	if !p.processContent(content, "", displayPath) {
+		return false
+	}
+	if p.dryRun {
+		return true
+	}
+	lang := p.stdinLang
+	if lang == "" {
+		lang = getLanguageHint(displayPath)
+	}
+	// Without a hint from -stdin-lang or -stdin-name, keep the language of a shebang line
+	if lang != "" {
+		p.blocks[len(p.blocks)-1].lang = lang
+	}
+	return true
+}
+
+// processFile reads a file and appends its content formatted as a markdown code block to the builder.
+// It reports whether the file was added to the output.
+func (p *processor) processFile(absFilePath string, displayFilePath string) bool {
+	return p.processFileWith(absFilePath, displayFilePath, readFile)
+}
+
+// processFileWith is processFile with the content read by read, such as the reads ahead of a directory walk.
+func (p *processor) processFileWith(absFilePath string, displayFilePath string, read func(string) fileContent) bool {
+	if p.dryRun {
+		return p.dryRunFile(absFilePath, displayFilePath)
+	}
+	if p.blame {
+		if annotated, err := gitBlame(p.ctx, absFilePath); err == nil {
+			if !p.processContent(annotated, absFilePath, displayFilePath) {
+				return false
 			}
-			isBinary = true
-			break
+			block := &p.blocks[len(p.blocks)-1]
+			block.notes = append(block.notes, "git blame")
+			return true
 		}
+		fmt.Fprintf(os.Stderr, "No git blame for %s, including its plain content\n", displayFilePath)
 	}
+
+	file := read(absFilePath)
+	if file.err != nil {
+		p.reportError("Error reading file %s: %v", displayFilePath, file.err)
+		return false
+	}
+	// A file over readLimit was only sampled, which is enough for the size and binary checks to skip it
+	if file.sampled {
+		p.admitContent(displayFilePath, file.content, file.size)
+		return false
+	}
+
+	return p.processContent(file.content, absFilePath, displayFilePath)
+}
+
+// processContent applies the size and binary checks to already loaded file content
+// and appends it formatted as a markdown code block to the builder. It reports whether the content was added.
+func (p *processor) processContent(content []byte, absFilePath string, displayFilePath string) bool {
+	isBinary, ok := p.admitContent(displayFilePath, content, len(content))
+	if !ok {
+		return false
+	}
+	if p.dryRun {
+		p.addDryRunEntry(absFilePath, displayFilePath, content, len(content), isBinary)
+		return true
+	}
+
 	if isBinary {
+		fmt.Fprintf(os.Stderr, "Adding binary file as base64: %s\n", displayFilePath)
+		p.included = append(p.included, displayFilePath)
+		p.stats.included++
+		p.stats.includedBytes += len(content)
+		p.blocks = append(p.blocks, outputBlock{
+			lang:    "base64",
+			title:   displayFilePath,
+			notes:   append(p.headerNotes(absFilePath, nil), "binary, "+formatSize(len(content))),
+			content: []byte(wrapBase64(content)),
+			isFile:  true,
+			absPath: absFilePath,
+		})
+		return true
+	}
+
+	// Content transforms run in a fixed order: -filter commands, region extraction and whitespace cleanup first,
+	// so the line length checks and the -exclude-content match see the content as it will be emitted.
+	// UTF-16 text is converted to UTF-8 before anything else.
+	content = decodeUTF16(content)
+	raw := content
+	for _, filter := range p.filters {
+		filtered, err := p.runFilter(filter, content, absFilePath, displayFilePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: skipping %s: filter `%s` failed: %v\n", displayFilePath, filter, err)
+			p.stats.skip(skipFilterFailed, displayFilePath)
+			return false
+		}
+		content = filtered
+	}
+
+	var notes []string
+	var regions []string
+	if p.regionStart != "" && p.regionEnd != "" {
+		regions = extractRegions(content, p.regionStart, p.regionEnd)
+	}
+	if len(regions) > 0 {
+		// Regions are dedented one by one, as they can sit at different depths
+		if p.dedent {
+			for i, region := range regions {
+				regions[i] = string(dedent([]byte(region)))
+			}
+		}
+		content = joinRegions(regions)
+		notes = append(notes, fmt.Sprintf("%d region(s) between %s and %s", len(regions), p.regionStart, p.regionEnd))
+	} else if p.dedent {
+		content = dedent(content)
+	}
+	if p.stripTrailingSpace {
+		content = stripTrailingWhitespace(content)
+	}
+	// Numbered lines are read side by side, so tabs are expanded at the project's width to keep them aligned
+	if p.expandTabs || p.lineNumbers {
+		content = expandTabs(content, p.tabWidth(absFilePath))
+	}
+	if p.maxLineLength > 0 {
+		if longest := longestLineLength(content); longest > p.maxLineLength {
+			if !p.truncateLongLines {
+				fmt.Fprintf(os.Stderr, "Skipping file with very long lines (%d > %d chars): %s\n", longest, p.maxLineLength, displayFilePath)
+				p.stats.skip(skipLongLines, displayFilePath)
+				return false
+			}
+			var truncated int
+			content, truncated = truncateLongLines(content, p.maxLineLength)
+			fmt.Fprintf(os.Stderr, "Truncated %d long line(s) in %s\n", truncated, displayFilePath)
+			notes = append(notes, fmt.Sprintf("%d long line(s) truncated", truncated))
+		}
+	}
+
+	if p.excludeContent != nil {
+		if loc := p.excludeContent.FindIndex(content); loc != nil {
+			fmt.Fprintf(os.Stderr, "Skipping file with excluded content: %s (matched '%s')\n", displayFilePath, content[loc[0]:loc[1]])
+			p.stats.skip(skipExcludedContent, displayFilePath)
+			return false
+		}
+	}
+
+	lang := p.languageOf(absFilePath, raw)
+	if p.pruneCommentsOnly && onlyComments(lang, content) {
+		fmt.Fprintf(os.Stderr, "Skipping file with only comments: %s\n", displayFilePath)
+		p.stats.skip(skipCommentsOnly, displayFilePath)
+		return false
+	}
+	if p.repoMap {
+		symbols, _ := repoMapSymbols(lang, content)
+		fmt.Fprintf(os.Stderr, "Mapping file: %s (%d symbols)\n", displayFilePath, len(symbols))
+		p.included = append(p.included, displayFilePath)
+		p.stats.included++
+		p.stats.includedBytes += len(content)
+		p.repoMapEntries = append(p.repoMapEntries, repoMapEntry{path: p.renameDisplay(displayFilePath), symbols: symbols})
+		return true
+	}
+
+	if p.goOutline && lang == "go" {
+		if outline, err := goOutline(content); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not parse %s for -go-outline, emitting the full file: %v\n", displayFilePath, err)
+		} else {
+			content = outline
+			notes = append(notes, "outline")
+		}
+	}
+
+	if p.lineNumbers {
+		content = numberLines(content)
+	}
+
+	if p.tokenReport > 0 {
+		fmt.Fprintf(os.Stderr, "Adding file: %s (~%d tokens)\n", displayFilePath, countTokens(string(content)))
+	} else {
+		fmt.Fprintf(os.Stderr, "Adding file: %s\n", displayFilePath)
+	}
+	p.included = append(p.included, displayFilePath)
+	p.stats.included++
+	p.stats.includedBytes += len(content)
+
+	p.blocks = append(p.blocks, outputBlock{
+		lang:    lang,
+		title:   displayFilePath,
+		notes:   append(p.headerNotes(absFilePath, content), notes...),
+		content: content,
+		isFile:  true,
+		absPath: absFilePath,
+	})
+	return true
+}
+
+// admitContent applies the -max-matches, binary and size checks to a file of size bytes, sample being its
+// content or, for -dry-run, its first bytes. It reports whether the content is binary and whether it passed.
+func (p *processor) admitContent(displayFilePath string, sample []byte, size int) (isBinary bool, ok bool) {
+	if p.maxMatches > 0 && p.stats.included >= p.maxMatches {
+		if !p.matchLimitHit {
+			fmt.Fprintf(os.Stderr, "Warning: reached -max-matches %d, no further files are included.\n", p.maxMatches)
+			p.matchLimitHit = true
+		}
+		p.stats.skip(skipMaxMatches, displayFilePath)
+		return false, false
+	}
+
+	isBinary = isBinaryContent(sample)
+	if isBinary && !p.includeBinary {
 		fmt.Fprintf(os.Stderr, "Skipping likely binary file: %s\n", displayFilePath)
+		p.stats.skip(skipBinary, displayFilePath)
+		return true, false
+	}
+
+	maxSize, limitFlag := p.maxSize, "-max-file-size"
+	if isBinary {
+		maxSize, limitFlag = p.maxBinarySize, "-max-binary-size"
+	}
+	if maxSize > 0 && int64(size) > maxSize {
+		fmt.Fprintf(os.Stderr, "Skipping large file: %s (%s, over the %s limit of %s)\n", displayFilePath, formatSize(size), limitFlag, formatSize(int(maxSize)))
+		p.stats.skip(skipTooLarge, displayFilePath)
+		return isBinary, false
+	}
+	return isBinary, true
+}
+
+// readLimit is the size over which admitContent skips a file whatever its content, so reads can stop at a
+// sample of its start: -max-file-size, or the larger of both limits when binary files are included. 0 means
+// no limit.
+func (p *processor) readLimit() int64 {
+	if !p.includeBinary {
+		return p.maxSize
+	}
+	if p.maxSize == 0 || p.maxBinarySize == 0 {
+		return 0
+	}
+	return max(p.maxSize, p.maxBinarySize)
+}
+
+// binarySampleSize is how much of the start of a file isBinaryContent examines.
+const binarySampleSize = 8 << 10
+
+// readSample reads the first binarySampleSize bytes of r, or all of it when it is shorter.
+func readSample(r io.Reader) ([]byte, error) {
+	sample := make([]byte, binarySampleSize)
+	n, err := io.ReadFull(r, sample)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+	return sample[:n], nil
+}
+
+// isBinaryContent reports whether content looks binary from its first binarySampleSize bytes. Text starting
+// with a UTF-16 byte order mark is text. Otherwise content is binary when http.DetectContentType recognizes
+// the magic number of a media, font or archive format, when it holds a NUL byte, or when over 30% of it is
+// control characters or invalid UTF-8.
+func isBinaryContent(content []byte) bool {
+	sample := content[:min(len(content), binarySampleSize)]
+	if utf16ByteOrder(sample) != nil {
+		return false
+	}
+
+	// The two byte "BM" signature of BMP images is too easily the start of a text file to be trusted
+	contentType := http.DetectContentType(sample)
+	for _, prefix := range []string{"image/", "audio/", "video/", "font/"} {
+		if strings.HasPrefix(contentType, prefix) && contentType != "image/bmp" {
+			return true
+		}
+	}
+	switch contentType {
+	case "application/pdf", "application/zip", "application/x-gzip", "application/x-rar-compressed",
+		"application/wasm", "application/ogg", "application/vnd.ms-fontobject":
+		return true
+	}
+
+	if bytes.IndexByte(sample, 0) >= 0 {
+		return true
+	}
+	suspicious := 0
+	for i := 0; i < len(sample); {
+		r, size := utf8.DecodeRune(sample[i:])
+		if (r == utf8.RuneError && size == 1) || r == 0x7f || (r < 0x20 && !strings.ContainsRune("\t\n\v\f\r", r)) {
+			suspicious += size
+		}
+		i += size
+	}
+	return suspicious*10 > len(sample)*3
+}
+
+// utf16ByteOrder returns the byte order announced by the UTF-16 byte order mark content starts with, if any.
+func utf16ByteOrder(content []byte) binary.ByteOrder {
+	switch {
+	case bytes.HasPrefix(content, []byte{0xFF, 0xFE}):
+		return binary.LittleEndian
+	case bytes.HasPrefix(content, []byte{0xFE, 0xFF}):
+		return binary.BigEndian
+	}
+	return nil
+}
+
+// decodeUTF16 converts content starting with a UTF-16 byte order mark to UTF-8, without the mark.
+// Other content is returned unchanged.
+func decodeUTF16(content []byte) []byte {
+	order := utf16ByteOrder(content)
+	if order == nil {
+		return content
+	}
+	units := make([]uint16, 0, len(content)/2)
+	for i := 2; i+1 < len(content); i += 2 {
+		units = append(units, order.Uint16(content[i:]))
+	}
+	return []byte(string(utf16.Decode(units)))
+}
+
+// languageOf returns the language hint of a file: its -lang-for override, the hint of its name,
+// or the language of the shebang line of raw, its content before any transform.
+func (p *processor) languageOf(absFilePath string, raw []byte) string {
+	if lang, forced := p.langOverrides[absFilePath]; forced {
+		return lang
+	}
+	if lang := getLanguageHint(absFilePath); lang != "" {
+		return lang
+	}
+	return shebangLanguage(raw)
+}
+
+// dryRunFile applies the checks of processContent that don't need the whole content to a file for -dry-run,
+// from its size and first bytes. Content based checks, such as -exclude-content and -max-line-length, are skipped.
+func (p *processor) dryRunFile(absFilePath string, displayFilePath string) bool {
+	file, err := os.Open(absFilePath)
+	if err != nil {
+		p.reportError("Error reading file %s: %v", displayFilePath, err)
+		return false
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		p.reportError("Error reading file %s: %v", displayFilePath, err)
+		return false
+	}
+	sample, err := readSample(file)
+	if err != nil {
+		p.reportError("Error reading file %s: %v", displayFilePath, err)
+		return false
+	}
+
+	isBinary, ok := p.admitContent(displayFilePath, sample, int(info.Size()))
+	if !ok {
+		return false
+	}
+	p.addDryRunEntry(absFilePath, displayFilePath, sample, int(info.Size()), isBinary)
+	return true
+}
+
+// addDryRunEntry records a file that passed the -dry-run checks.
+func (p *processor) addDryRunEntry(absFilePath string, displayFilePath string, sample []byte, size int, isBinary bool) {
+	lang := "binary"
+	if !isBinary {
+		lang = p.languageOf(absFilePath, sample)
+	}
+	p.included = append(p.included, displayFilePath)
+	p.stats.included++
+	p.stats.includedBytes += size
+	p.dryRunFiles = append(p.dryRunFiles, dryRunEntry{path: displayFilePath, size: size, lang: lang})
+}
+
+// stripTrailingWhitespace removes spaces and tabs at the end of every line, keeping the line endings.
+func stripTrailingWhitespace(content []byte) []byte {
+	var out bytes.Buffer
+	out.Grow(len(content))
+	for _, line := range bytes.SplitAfter(content, []byte("\n")) {
+		body := bytes.TrimSuffix(line, []byte("\n"))
+		ending := line[len(body):]
+		if trimmed := bytes.TrimSuffix(body, []byte("\r")); len(trimmed) < len(body) {
+			body, ending = trimmed, line[len(trimmed):]
+		}
+		out.Write(bytes.TrimRight(body, " \t"))
+		out.Write(ending)
+	}
+	return out.Bytes()
+}
+
+// dedent removes the leading whitespace common to all non-blank lines, keeping their relative indentation.
+// Tabs and spaces are not interchangeable: the common prefix must be identical on every line.
+func dedent(content []byte) []byte {
+	lines := bytes.SplitAfter(content, []byte("\n"))
+	var prefix []byte
+	first := true
+	for _, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		indent := line[:len(line)-len(bytes.TrimLeft(line, " \t"))]
+		if first {
+			prefix, first = indent, false
+			continue
+		}
+		n := 0
+		for n < len(prefix) && n < len(indent) && prefix[n] == indent[n] {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	if len(prefix) == 0 {
+		return content
+	}
+
+	var out bytes.Buffer
+	out.Grow(len(content))
+	for _, line := range lines {
+		if trimmed, ok := bytes.CutPrefix(line, prefix); ok {
+			out.Write(trimmed)
+		} else {
+			// A blank line shorter than the common indentation
+			out.Write(bytes.TrimLeft(line, " \t"))
+		}
+	}
+	return out.Bytes()
+}
+
+// numberLines prefixes every line with its number, right-aligned to the width of the last one, and " | ".
+// A final newline does not start another line.
+func numberLines(content []byte) []byte {
+	if len(content) == 0 {
+		return content
+	}
+	lines := bytes.SplitAfter(content, []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	width := len(strconv.Itoa(len(lines)))
+
+	var out bytes.Buffer
+	out.Grow(len(content) + len(lines)*(width+3))
+	for i, line := range lines {
+		fmt.Fprintf(&out, "%*d | ", width, i+1)
+		out.Write(line)
+	}
+	return out.Bytes()
+}
+
+// longestLineLength returns the length in bytes of the longest line in content.
+func longestLineLength(content []byte) int {
+	longest := 0
+	for len(content) > 0 {
+		line := content
+		if idx := bytes.IndexByte(content, '\n'); idx >= 0 {
+			line, content = content[:idx], content[idx+1:]
+		} else {
+			content = nil
+		}
+		if len(line) > longest {
+			longest = len(line)
+		}
+	}
+	return longest
+}
+
+// truncateLongLines cuts every line longer than maxLength (on a rune boundary) and marks how much was dropped.
+// It returns the new content and the number of lines that were truncated.
+func truncateLongLines(content []byte, maxLength int) ([]byte, int) {
+	var out bytes.Buffer
+	truncated := 0
+	lines := bytes.SplitAfter(content, []byte("\n"))
+	for _, line := range lines {
+		body := bytes.TrimSuffix(line, []byte("\n"))
+		if len(body) <= maxLength {
+			out.Write(line)
+			continue
+		}
+		cut := maxLength
+		for cut > 0 && !utf8.RuneStart(body[cut]) {
+			cut--
+		}
+		out.Write(body[:cut])
+		fmt.Fprintf(&out, " … [truncated %d bytes]", len(body)-cut)
+		if len(body) < len(line) {
+			out.WriteByte('\n')
+		}
+		truncated++
+	}
+	return out.Bytes(), truncated
+}
+
+// headerNotes returns the optional annotations shown in parentheses after a file's path in its header.
+func (p *processor) headerNotes(absFilePath string, content []byte) []string {
+	var notes []string
+	if p.showLines {
+		lines := bytes.Count(content, []byte("\n"))
+		if len(content) > 0 && content[len(content)-1] != '\n' {
+			lines++
+		}
+		if lines == 1 {
+			notes = append(notes, "1 line")
+		} else {
+			notes = append(notes, fmt.Sprintf("%d lines", lines))
+		}
+	}
+	if p.showMode {
+		if info, err := os.Stat(absFilePath); err == nil {
+			mode := info.Mode().Perm()
+			if mode&0111 != 0 {
+				notes = append(notes, fmt.Sprintf("mode %04o, executable", mode))
+			} else {
+				notes = append(notes, fmt.Sprintf("mode %04o", mode))
+			}
+		}
+	}
+	if p.gitMTime && absFilePath != "" {
+		if date, ok := p.gitLastCommitDate(absFilePath); ok {
+			notes = append(notes, "last commit "+date)
+		}
+	}
+	return notes
+}
+
+// addTargetHeader writes a "path:::header" text before the first block added for a target since start.
+func (p *processor) addTargetHeader(start int, header string) {
+	if start >= len(p.blocks) {
 		return
 	}
+	if existing := p.blocks[start].heading; existing != "" {
+		header += "\n\n" + existing
+	}
+	p.blocks[start].heading = header
+}
 
-	fmt.Fprintf(os.Stderr, "Adding file: %s\n", displayFilePath)
+// renameDisplay rewrites the first -rename-display prefix matching a display path.
+// A prefix without a trailing slash only matches whole path components.
+func (p *processor) renameDisplay(path string) string {
+	for _, r := range p.renames {
+		if r.from == path {
+			return r.to
+		}
+		prefix := r.from
+		if !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		if rest, ok := strings.CutPrefix(path, prefix); ok {
+			if r.to == "" {
+				return rest
+			}
+			return strings.TrimSuffix(r.to, "/") + "/" + rest
+		}
+	}
+	return path
+}
 
-	if builder.Len() > 0 {
-		builder.WriteString("\n\n")
+// outputBlocks returns the collected blocks ready for rendering, with display paths rewritten by -rename-display,
+// duplicates folded when -dedup-content is set, files reordered by -sort,
+// files clustered by language when -group-by-language is set
+// and file blocks marked for HTML comment delimiters when -html-markers is set.
+func (p *processor) outputBlocks() []outputBlock {
+	blocks := p.blocks
+	if len(p.renames) > 0 || p.htmlMarkers {
+		blocks = slices.Clone(blocks)
+		for i := range blocks {
+			if blocks[i].isFile {
+				blocks[i].title = p.renameDisplay(blocks[i].title)
+				blocks[i].htmlMarker = p.htmlMarkers
+			}
+		}
+	}
+	if p.dedupContent {
+		blocks = dedupBlocks(blocks)
 	}
+	if p.sortBy != "" {
+		blocks = sortFileBlocks(blocks, p.sortBy, p.sortReverse)
+	}
+	if p.groupByLang {
+		blocks = groupBlocksByLanguage(blocks, p.sortBy == "")
+	}
+	return blocks
+}
 
-	lang := getLanguageHint(absFilePath)
-	header := displayFilePath
-	if lang != "" {
-		header = lang + " " + displayFilePath
+// groupBlocksByLanguage reorders file blocks into one group per language, in order of each language's
+// first appearance, and heads every group with "## <language>". Files are sorted by path within a group
+// when byPath is set, and keep their relative order (from -sort) otherwise; generated blocks such as trees
+// and command output follow the groups unchanged.
+func groupBlocksByLanguage(blocks []outputBlock, byPath bool) []outputBlock {
+	var languages []string
+	byLanguage := make(map[string][]outputBlock)
+	var others []outputBlock
+
+	for _, block := range blocks {
+		if !block.isFile {
+			others = append(others, block)
+			continue
+		}
+		lang := block.lang
+		if lang == "" {
+			lang = "other"
+		}
+		if _, ok := byLanguage[lang]; !ok {
+			languages = append(languages, lang)
+		}
+		byLanguage[lang] = append(byLanguage[lang], block)
 	}
 
-	builder.WriteString(fmt.Sprintf("```%s\n", header))
-	builder.Write(content)
-	if len(content) > 0 && content[len(content)-1] != '\n' {
+	result := make([]outputBlock, 0, len(blocks))
+	for _, lang := range languages {
+		group := byLanguage[lang]
+		if byPath {
+			slices.SortStableFunc(group, func(a, b outputBlock) int { return strings.Compare(a.title, b.title) })
+		}
+		heading := "## " + lang
+		if group[0].heading != "" {
+			heading += "\n\n" + group[0].heading
+		}
+		group[0].heading = heading
+		result = append(result, group...)
+	}
+	return append(result, others...)
+}
+
+// render formats the collected blocks with the output formatter.
+func (p *processor) render() string {
+	return p.renderWith(p.formatter)
+}
+
+// renderWith renders the collected blocks with f, such as the markdown of -o-markdown whatever -format is.
+func (p *processor) renderWith(f formatter) string {
+	var rendered []string
+	for _, block := range p.outputBlocks() {
+		rendered = append(rendered, f.block(block))
+	}
+	return f.join(rendered)
+}
+
+// render formats a single block as an optional heading followed by a fenced code block,
+// itself between HTML comment delimiters when the block has an htmlMarker.
+func (block outputBlock) render() string {
+	var builder strings.Builder
+	if block.heading != "" {
+		builder.WriteString(block.heading)
+		if !strings.HasSuffix(block.heading, "\n") {
+			builder.WriteByte('\n')
+		}
+		builder.WriteByte('\n')
+	}
+	if block.htmlMarker {
+		builder.WriteString("<!-- file: " + block.title + " -->\n")
+	}
+
+	header := block.title
+	if len(block.notes) > 0 {
+		header += " (" + strings.Join(block.notes, ", ") + ")"
+	}
+	if block.lang != "" {
+		header = block.lang + " " + header
+	}
+
+	fence := codeFence(block.content)
+	builder.WriteString(fence + header + "\n")
+	builder.Write(block.content)
+	if len(block.content) > 0 && block.content[len(block.content)-1] != '\n' {
 		builder.WriteByte('\n')
 	}
-	builder.WriteString("```\n")
+	builder.WriteString(fence + "\n")
+	if block.htmlMarker {
+		builder.WriteString("<!-- end file: " + block.title + " -->\n")
+	}
+	return builder.String()
+}
+
+// codeFence returns a backtick fence one longer than the longest run of backticks in content, and at
+// least three long, so a markdown file holding its own fenced blocks cannot close the block early.
+func codeFence(content []byte) string {
+	longest, run := 0, 0
+	for _, c := range content {
+		if c == '`' {
+			run++
+			longest = max(longest, run)
+		} else {
+			run = 0
+		}
+	}
+	return strings.Repeat("`", max(3, longest+1))
+}
+
+// planChunks groups pieces of output, in order, into chunks of at most maxTokens estimated tokens each,
+// splitting only between pieces. A piece larger than maxTokens gets a chunk of its own.
+// It returns the estimated token count of every chunk.
+func planChunks(pieces []string, maxTokens int) []int {
+	var chunks []int
+	current := 0
+	for _, piece := range pieces {
+		tokens := countTokens(piece)
+		if current > 0 && current+tokens > maxTokens {
+			chunks = append(chunks, current)
+			current = 0
+		}
+		current += tokens
+	}
+	if current > 0 {
+		chunks = append(chunks, current)
+	}
+	return chunks
+}
+
+// jsonFile is the -format json representation of an output block.
+type jsonFile struct {
+	Path          string `json:"path"`
+	Language      string `json:"language"`
+	Bytes         int    `json:"bytes"`
+	TokenEstimate int    `json:"tokenEstimate"`
+	Content       string `json:"content"`
+}
+
+// renderJSON formats blocks as an indented JSON array of {path, language, bytes, tokenEstimate, content} objects.
+func renderJSON(blocks []outputBlock) (string, error) {
+	files := make([]jsonFile, 0, len(blocks))
+	for _, block := range blocks {
+		files = append(files, jsonFile{
+			Path:          block.title,
+			Language:      block.lang,
+			Bytes:         len(block.content),
+			TokenEstimate: countTokens(string(block.content)),
+			Content:       string(block.content),
+		})
+	}
+
+	var sb strings.Builder
+	encoder := json.NewEncoder(&sb)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(files); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// sortKeys are the -sort orders; all but path put the largest or newest files first.
+var sortKeys = []string{"path", "size", "tokens", "mtime"}
+
+// sortFileBlocks reorders the file blocks by key, stably, reversed when reverse is set. Other blocks, such as
+// command output, keep their position: file blocks are only moved between the slots file blocks occupy.
+func sortFileBlocks(blocks []outputBlock, key string, reverse bool) []outputBlock {
+	var slots []int
+	type sortedBlock struct {
+		block outputBlock
+		value int64
+	}
+	var files []sortedBlock
+	for i, block := range blocks {
+		if !block.isFile {
+			continue
+		}
+		slots = append(slots, i)
+		file := sortedBlock{block: block}
+		switch key {
+		case "size":
+			file.value = int64(len(block.content))
+		case "tokens":
+			file.value = int64(countTokens(string(block.content)))
+		case "mtime":
+			// Blocks not read from a file, such as diffs, sort as the oldest
+			if info, err := os.Stat(block.absPath); block.absPath != "" && err == nil {
+				file.value = info.ModTime().UnixNano()
+			}
+		}
+		files = append(files, file)
+	}
+
+	slices.SortStableFunc(files, func(a, b sortedBlock) int {
+		var order int
+		if key == "path" {
+			order = strings.Compare(a.block.title, b.block.title)
+		} else {
+			order = cmp.Compare(b.value, a.value)
+		}
+		if reverse {
+			return -order
+		}
+		return order
+	})
+
+	result := slices.Clone(blocks)
+	for i, slot := range slots {
+		result[slot] = files[i].block
+	}
+	return result
+}
+
+// dedupBlocks keeps only the first of several byte-identical files, noting the paths of the others on it.
+func dedupBlocks(blocks []outputBlock) []outputBlock {
+	var result []outputBlock
+	aliases := make(map[int][]string)
+	firstByHash := make(map[[sha256.Size]byte]int)
+
+	for _, block := range blocks {
+		if !block.isFile {
+			result = append(result, block)
+			continue
+		}
+		sum := sha256.Sum256(block.content)
+		if idx, ok := firstByHash[sum]; ok {
+			fmt.Fprintf(os.Stderr, "Deduplicated %s (identical to %s)\n", block.title, result[idx].title)
+			aliases[idx] = append(aliases[idx], block.title)
+			continue
+		}
+		firstByHash[sum] = len(result)
+		result = append(result, block)
+	}
+
+	for idx, paths := range aliases {
+		notes := append([]string(nil), result[idx].notes...)
+		result[idx].notes = append(notes, "also at: "+strings.Join(paths, ", "))
+	}
+	return result
+}
+
+// languageByFilename maps lowercase file names that carry no useful extension to a language hint.
+var languageByFilename = map[string]string{
+	"caddyfile":     "caddyfile",
+	"dockerfile":    "dockerfile",
+	"containerfile": "dockerfile",
+	"makefile":      "makefile",
+	"go.mod":        "go.mod",
+	"go.work":       "go.mod",
+	"cargo.toml":    "toml",
+	"package.json":  "json",
+}
+
+// testFilePatterns are the file name conventions of tests, per language, used by -exclude-tests and -only-tests.
+var testFilePatterns = []string{
+	// Go
+	"*_test.go",
+	// Python
+	"test_*.py", "*_test.py",
+	// JavaScript and TypeScript
+	"*.test.js", "*.test.jsx", "*.test.ts", "*.test.tsx",
+	"*.spec.js", "*.spec.jsx", "*.spec.ts", "*.spec.tsx",
+	// Ruby
+	"*_spec.rb", "*_test.rb",
+	// Java and Kotlin
+	"*Test.java", "*Tests.java", "*Test.kt",
+}
+
+// testDirNames are directories whose files are all considered tests.
+var testDirNames = map[string]bool{
+	"test":      true,
+	"tests":     true,
+	"__tests__": true,
+	"spec":      true,
+}
+
+// isTestFile reports whether a slash separated path follows one of the test file conventions.
+func isTestFile(relativePath string) bool {
+	parts := strings.Split(relativePath, "/")
+	for _, dir := range parts[:len(parts)-1] {
+		if testDirNames[dir] {
+			return true
+		}
+	}
+	for _, pattern := range testFilePatterns {
+		if matched, _ := filepath.Match(pattern, parts[len(parts)-1]); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// testSkipped reports whether -exclude-tests or -only-tests leaves a file out, with the skip reason.
+func (p *processor) testSkipped(relativePath string) (bool, string) {
+	switch isTest := isTestFile(filepath.ToSlash(relativePath)); {
+	case p.tests == "exclude" && isTest:
+		return true, skipTests
+	case p.tests == "only" && !isTest:
+		return true, skipNotTests
+	}
+	return false, ""
+}
+
+// lockFiles are generated dependency manifests: large, noisy and rarely useful as context.
+// Directory walks skip them unless -include-lockfiles is set; naming one explicitly still includes it.
+var lockFiles = map[string]bool{
+	"go.sum":            true,
+	"go.work.sum":       true,
+	"cargo.lock":        true,
+	"package-lock.json": true,
+	"yarn.lock":         true,
+	"pnpm-lock.yaml":    true,
+	"poetry.lock":       true,
+	"composer.lock":     true,
+	"gemfile.lock":      true,
+}
+
+// languageByExtension maps lowercase file extensions to a language hint.
+// Unknown extensions fall back to the extension itself.
+var languageByExtension = map[string]string{
+	".go":         "go",
+	".md":         "markdown",
+	".markdown":   "markdown",
+	".sh":         "bash",
+	".bash":       "bash",
+	".py":         "python",
+	".js":         "javascript",
+	".mjs":        "javascript",
+	".cjs":        "javascript",
+	".ts":         "typescript",
+	".tsx":        "typescript",
+	".java":       "java",
+	".c":          "c",
+	".h":          "c",
+	".cpp":        "cpp",
+	".cxx":        "cpp",
+	".hpp":        "cpp",
+	".hxx":        "cpp",
+	".cc":         "cpp",
+	".hh":         "cpp",
+	".cs":         "csharp",
+	".rb":         "ruby",
+	".php":        "php",
+	".swift":      "swift",
+	".kt":         "kotlin",
+	".kts":        "kotlin",
+	".rs":         "rust",
+	".html":       "html",
+	".htm":        "html",
+	".css":        "css",
+	".json":       "json",
+	".toml":       "toml",
+	".yaml":       "yaml",
+	".yml":        "yaml",
+	".xml":        "xml",
+	".sql":        "sql",
+	".dockerfile": "dockerfile",
+	".tf":         "hcl",
+	".tfvars":     "hcl",
+	".hcl":        "hcl",
+	".txt":        "text",
+	".text":       "text",
 }
 
 // getLanguageHint determines a language hint from the file extension.
@@ -550,63 +3206,88 @@ func getLanguageHint(filePath string) string {
 	ext := strings.ToLower(filepath.Ext(filePath))
 	baseName := strings.ToLower(filepath.Base(filePath))
 
-	switch baseName {
-	case "caddyfile":
-		return "caddyfile"
-	case "dockerfile", "containerfile":
-		return "dockerfile"
-	case "makefile":
-		return "makefile"
-	}
-
-	switch ext {
-	case ".go":
-		return "go"
-	case ".md", ".markdown":
-		return "markdown"
-	case ".sh", ".bash":
-		return "bash"
-	case ".py":
-		return "python"
-	case ".js", ".mjs", ".cjs":
-		return "javascript"
-	case ".ts", ".tsx":
-		return "typescript"
-	case ".java":
-		return "java"
-	case ".c", ".h":
-		return "c"
-	case ".cpp", ".cxx", ".hpp", ".hxx", ".cc", ".hh":
-		return "cpp"
-	case ".cs":
-		return "csharp"
-	case ".rb":
-		return "ruby"
-	case ".php":
-		return "php"
-	case ".swift":
-		return "swift"
-	case ".kt", ".kts":
-		return "kotlin"
-	case ".rs":
-		return "rust"
-	case ".html", ".htm":
-		return "html"
-	case ".css":
-		return "css"
-	case ".json":
-		return "json"
-	case ".yaml", ".yml":
-		return "yaml"
-	case ".xml":
-		return "xml"
-	case ".sql":
-		return "sql"
-	case ".dockerfile":
-		return "dockerfile"
-	case ".txt", ".text":
-		return "text"
-	default:
-		return strings.TrimPrefix(ext, ".")
+	if lang, ok := languageByFilename[baseName]; ok {
+		return lang
+	}
+	if lang, ok := languageByExtension[ext]; ok {
+		return lang
+	}
+	return strings.TrimPrefix(ext, ".")
+}
+
+// languageByInterpreter maps the interpreters named in shebang lines to a language hint.
+var languageByInterpreter = map[string]string{
+	"sh":      "bash",
+	"bash":    "bash",
+	"dash":    "bash",
+	"ksh":     "bash",
+	"zsh":     "zsh",
+	"fish":    "fish",
+	"python":  "python",
+	"node":    "javascript",
+	"nodejs":  "javascript",
+	"deno":    "typescript",
+	"bun":     "javascript",
+	"ts-node": "typescript",
+	"tsx":     "typescript",
+	"ruby":    "ruby",
+	"perl":    "perl",
+	"php":     "php",
+	"lua":     "lua",
+	"rscript": "r",
+	"awk":     "awk",
+	"tclsh":   "tcl",
+	"pwsh":    "powershell",
+}
+
+// shebangLanguage returns the language hint of the interpreter named by a "#!" first line, such as
+// "#!/bin/bash" or "#!/usr/bin/env python3", or "" without a known one. Only the first line is read.
+func shebangLanguage(content []byte) string {
+	if !bytes.HasPrefix(content, []byte("#!")) {
+		return ""
+	}
+	line, _, _ := bytes.Cut(content[2:], []byte("\n"))
+	fields := strings.Fields(string(line))
+	if len(fields) == 0 {
+		return ""
+	}
+	interpreter := filepath.Base(fields[0])
+	if interpreter == "env" {
+		// Skip the options of env, like -S, to the command it runs
+		interpreter = ""
+		for _, field := range fields[1:] {
+			if !strings.HasPrefix(field, "-") && !strings.Contains(field, "=") {
+				interpreter = filepath.Base(field)
+				break
+			}
+		}
+	}
+	// Versioned interpreters such as python3 or python3.12 map like their base name
+	interpreter = strings.ToLower(strings.TrimRight(interpreter, "0123456789."))
+	return languageByInterpreter[interpreter]
+}
+
+// printLanguages writes the built-in file name and extension mappings used by getLanguageHint.
+func printLanguages(w io.Writer) {
+	fmt.Fprintln(w, "File names:")
+	printLanguageTable(w, languageByFilename)
+	fmt.Fprintln(w, "\nExtensions:")
+	printLanguageTable(w, languageByExtension)
+	fmt.Fprintln(w, "\nShebang interpreters, for files without an extension:")
+	printLanguageTable(w, languageByInterpreter)
+	fmt.Fprintln(w, "\nOther extensions are used as the language hint without their leading dot.")
+}
+
+// printLanguageTable writes a mapping sorted by key, one "key  language" pair per line.
+func printLanguageTable(w io.Writer, table map[string]string) {
+	keys := make([]string, 0, len(table))
+	width := 0
+	for key := range table {
+		keys = append(keys, key)
+		width = max(width, len(key))
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "  %-*s  %s\n", width, key, table[key])
 	}
 }
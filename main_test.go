@@ -0,0 +1,957 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writeFile creates path below dir with content, creating its parent directories.
+func writeFile(t *testing.T, dir string, path string, content string) {
+	t.Helper()
+	fullPath := filepath.Join(dir, filepath.FromSlash(path))
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fullPath, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadIgnoreFileEscapes(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, ".gitignore", "# comment\n\\#hash\ntrailing  \nspace\\ \n\\!bang\n!negated\nwin\r\n\n")
+
+	want := []string{"#hash", "trailing", "space ", `\!bang`, "!negated", "win"}
+	if got := readIgnoreFile(dir, ".gitignore"); !slices.Equal(got, want) {
+		t.Errorf("readIgnoreFile() = %q, want %q", got, want)
+	}
+}
+
+func TestUnescapeIgnorePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    string
+	}{
+		{"plain", "plain"},
+		{`\#hash`, "#hash"},
+		{`\!bang`, `\!bang`},
+		{`a\!b`, "a!b"},
+		{`space\ `, "space "},
+		{`\*.go`, `\*.go`},
+		{`back\\slash`, `back\\slash`},
+	}
+	for _, tt := range tests {
+		if got := unescapeIgnorePattern(tt.pattern); got != tt.want {
+			t.Errorf("unescapeIgnorePattern(%q) = %q, want %q", tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestIsExcludedEscapes(t *testing.T) {
+	tests := []struct {
+		path    string
+		pattern string
+		want    bool
+	}{
+		{"#hash", "#hash", true},
+		{"!bang", `\!bang`, true},
+		{"bang", `\!bang`, false},
+		{"space ", "space ", true},
+		{"space", "space ", false},
+		{"*.go", `\*.go`, true},
+		{"main.go", `\*.go`, false},
+	}
+	for _, tt := range tests {
+		if got, _ := isExcluded(tt.path, []string{tt.pattern}); got != tt.want {
+			t.Errorf("isExcluded(%q, %q) = %v, want %v", tt.path, tt.pattern, got, tt.want)
+		}
+	}
+}
+
+// setIgnoreCase sets matchIgnoreCase for the rest of the test, since its default depends on the OS.
+func setIgnoreCase(t *testing.T, ignoreCase bool) {
+	t.Helper()
+	saved := matchIgnoreCase
+	matchIgnoreCase = ignoreCase
+	t.Cleanup(func() { matchIgnoreCase = saved })
+}
+
+func TestIsExcludedIgnoreCase(t *testing.T) {
+	tests := []struct {
+		path       string
+		pattern    string
+		ignoreCase bool
+		want       bool
+	}{
+		{"README.md", "readme.md", false, false},
+		{"README.md", "readme.md", true, true},
+		{"Build", "build/", true, true},
+		{"Build/out.o", "build/*", false, false},
+		{"src/Main.GO", "*.go", true, true},
+		{"src/Main.GO", "!*.go", true, false},
+	}
+	for _, tt := range tests {
+		setIgnoreCase(t, tt.ignoreCase)
+		if got, _ := isExcluded(tt.path, []string{tt.pattern}); got != tt.want {
+			t.Errorf("isExcluded(%q, %q) with ignoreCase=%v = %v, want %v", tt.path, tt.pattern, tt.ignoreCase, got, tt.want)
+		}
+	}
+}
+
+func TestIsExcludedNegation(t *testing.T) {
+	setIgnoreCase(t, false)
+	tests := []struct {
+		path     string
+		patterns []string
+		want     bool
+		pattern  string
+	}{
+		{"app.log", []string{"*.log"}, true, "*.log"},
+		{"keep.log", []string{"*.log", "!keep.log"}, false, ""},
+		{"other.log", []string{"*.log", "!keep.log"}, true, "*.log"},
+		{"keep.log", []string{"!keep.log", "*.log"}, true, "*.log"},
+		{"keep.log", []string{"*.log", "!keep.log", "keep.*"}, true, "keep.*"},
+		{"main.go", []string{"!main.go"}, false, ""},
+		{"main.go", []string{"!", ""}, false, ""},
+		{"logs/keep.log", []string{"logs/*", "!logs/keep.log"}, false, ""},
+		{"a.tmp", []string{"*.tmp", "!keep.tmp"}, true, "*.tmp"},
+		{"keep.tmp", []string{"*.tmp", "!keep.tmp"}, false, ""},
+		{"cache/keep.tmp", []string{"*.tmp", "!keep.tmp"}, false, ""},
+	}
+	for _, tt := range tests {
+		got, pattern := isExcluded(tt.path, tt.patterns)
+		if got != tt.want || pattern != tt.pattern {
+			t.Errorf("isExcluded(%q, %q) = %v, %q, want %v, %q", tt.path, tt.patterns, got, pattern, tt.want, tt.pattern)
+		}
+	}
+}
+
+func TestProcessDirectoryNegationInIgnoredDirectory(t *testing.T) {
+	setIgnoreCase(t, false)
+	dir := t.TempDir()
+	writeFile(t, dir, ".gitignore", "build/\n!build/keep.txt\n")
+	for _, path := range []string{"main.go", "build/keep.txt", "build/out.o"} {
+		writeFile(t, dir, path, "x\n")
+	}
+
+	// As in git, a file cannot be re-included when its parent directory is excluded, so build/ is pruned whole
+	p := newTestProcessor()
+	p.processDirectory(dir, ".", readIgnoreFile(dir, ".gitignore"))
+	if want := []string{"main.go"}; !slices.Equal(p.included, want) {
+		t.Errorf("included = %q, want %q", p.included, want)
+	}
+}
+
+func TestGlobMatchDoubleStar(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"**/x", "x", true},
+		{"**/x", "a/b/x", true},
+		{"**/x", "a/x/b", false},
+		{"a/**/b", "a/b", true},
+		{"a/**/b", "a/x/y/b", true},
+		{"a/**/b", "c/a/b", false},
+		{"a/**", "a/b/c", true},
+		{"a/**", "a", false},
+		{"**/*.go", "cmd/main.go", true},
+		{"*.go", "cmd/main.go", false},
+		{"docs/**/*.md", "docs/api/v1/index.md", true},
+	}
+	for _, tt := range tests {
+		got, err := globMatch(tt.pattern, tt.name)
+		if err != nil {
+			t.Fatalf("globMatch(%q, %q): %v", tt.pattern, tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIsIncluded(t *testing.T) {
+	setIgnoreCase(t, false)
+	tests := []struct {
+		includes []string
+		path     string
+		want     bool
+	}{
+		{nil, "anything.txt", true},
+		{[]string{"*.go"}, "main.go", true},
+		{[]string{"*.go"}, "cmd/tool/main.go", true},
+		{[]string{"*.go"}, "README.md", false},
+		{[]string{"*.go", "*.md"}, "docs/README.md", true},
+		{[]string{"cmd/*.go"}, "cmd/main.go", true},
+		{[]string{"cmd/*.go"}, "internal/main.go", false},
+	}
+	for _, tt := range tests {
+		p := &processor{includes: tt.includes}
+		if got := p.isIncluded(tt.path); got != tt.want {
+			t.Errorf("isIncluded(%q) with %q = %v, want %v", tt.path, tt.includes, got, tt.want)
+		}
+	}
+}
+
+func TestCl100kPieces(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"Hello world", []string{"Hello", " world"}},
+		{"I'm here", []string{"I", "'m", " here"}},
+		{"WE'LL go", []string{"WE", "'LL", " go"}},
+		{"12345", []string{"123", "45"}},
+		{"foo  bar", []string{"foo", " ", " bar"}},
+		{"a\n\nb", []string{"a", "\n\n", "b"}},
+		{"x += 1;", []string{"x", " +=", " ", "1", ";"}},
+		{"f(){\n}", []string{"f", "(){\n", "}"}},
+		{"end  ", []string{"end", "  "}},
+	}
+	for _, tt := range tests {
+		if got := cl100kPieces(tt.text); !slices.Equal(got, tt.want) {
+			t.Errorf("cl100kPieces(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestBPECount(t *testing.T) {
+	ranks, err := parseRanks(strings.NewReader("YQ== 0\nYg== 1\nYw== 2\nZA== 3\nIA== 4\nYWI= 5\nY2Q= 6\nIGFi 7\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder := &bpeEncoder{name: "test", ranks: ranks}
+
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"", 0},
+		{"a", 1},
+		{"ab", 1},
+		{"abcd", 2},
+		{"abc", 2},
+		{"dcba", 4},
+		{"abcd abcd", 4},
+	}
+	for _, tt := range tests {
+		if got := encoder.count(tt.text); got != tt.want {
+			t.Errorf("count(%q) = %d, want %d", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestCl100kCounts(t *testing.T) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		t.Skip(err)
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, "fcopy", cl100kFileName)); err != nil {
+		t.Skipf("the cl100k_base ranks are not cached: %v", err)
+	}
+	encoder, err := loadCl100k(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"hello world", 2},
+		{"Hello, world!", 4},
+		{"tiktoken is great!", 6},
+		{"2 + 2 = 4", 7},
+		{"func main() {}", 4},
+		{"if err != nil {", 5},
+	}
+	for _, tt := range tests {
+		if got := encoder.count(tt.text); got != tt.want {
+			t.Errorf("count(%q) = %d, want %d", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestParseRanksErrors(t *testing.T) {
+	for _, content := range []string{"", "YQ==\n", "!!! 0\n", "YQ== zero\n"} {
+		if _, err := parseRanks(strings.NewReader(content)); err == nil {
+			t.Errorf("parseRanks(%q) succeeded, want an error", content)
+		}
+	}
+}
+
+func TestLoadCl100kRemovesCorruptedCache(t *testing.T) {
+	cacheHome := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", cacheHome)
+	t.Setenv("HOME", cacheHome)
+	t.Setenv("LocalAppData", cacheHome)
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		t.Skip(err)
+	}
+	path := filepath.Join(cacheDir, "fcopy", cl100kFileName)
+	writeFile(t, filepath.Dir(path), cl100kFileName, "YQ== 0\n")
+
+	if _, err := loadCl100k(context.Background()); err == nil || !strings.Contains(err.Error(), "sha256 mismatch") {
+		t.Fatalf("loadCl100k() error = %v, want a sha256 mismatch", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("the corrupted cache file was not removed: %v", err)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"512", 512, false},
+		{"512B", 512, false},
+		{"64K", 64 << 10, false},
+		{"64k", 64 << 10, false},
+		{"10MB", 10 << 20, false},
+		{"1GiB", 1 << 30, false},
+		{"1.5M", 3 << 19, false},
+		{" 2T ", 2 << 40, false},
+		{"", 0, true},
+		{"K", 0, true},
+		{"-1K", 0, true},
+		{"ten", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseSize(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d (error: %v)", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// captureStderr returns what f writes to os.Stderr.
+func captureStderr(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stderr
+	os.Stderr = w
+	defer func() { os.Stderr = saved }()
+
+	output := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		output <- string(data)
+	}()
+	f()
+	w.Close()
+	return <-output
+}
+
+func TestMaxFileSizeBoundary(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "five.txt", "12345")
+	writeFile(t, dir, "six.txt", "123456")
+
+	tests := []struct {
+		maxSize int64
+		want    []string
+		message string
+	}{
+		{5, []string{"five.txt"}, "Skipping large file: six.txt (6 B, over the -max-file-size limit of 5 B)"},
+		{6, []string{"five.txt", "six.txt"}, ""},
+		{0, []string{"five.txt", "six.txt"}, ""},
+	}
+	for _, tt := range tests {
+		p := newTestProcessor()
+		p.maxSize = tt.maxSize
+		stderr := captureStderr(t, func() { p.processDirectory(dir, ".", nil) })
+		if !slices.Equal(p.included, tt.want) {
+			t.Errorf("with a limit of %d, included = %q, want %q", tt.maxSize, p.included, tt.want)
+		}
+		if tt.message != "" && !strings.Contains(stderr, tt.message) {
+			t.Errorf("with a limit of %d, stderr = %q, want it to contain %q", tt.maxSize, stderr, tt.message)
+		}
+		if tt.message == "" && strings.Contains(stderr, "Skipping large file") {
+			t.Errorf("with a limit of %d, a file was skipped as too large: %q", tt.maxSize, stderr)
+		}
+	}
+}
+
+func TestXMLFormatterBlock(t *testing.T) {
+	tests := []struct {
+		name  string
+		block outputBlock
+		want  string
+	}{
+		{
+			name:  "file",
+			block: outputBlock{isFile: true, lang: "go", title: "main.go", content: []byte("package main\n")},
+			want:  "<file path=\"main.go\" language=\"go\">\npackage main\n</file>\n",
+		},
+		{
+			name:  "closing tag in content",
+			block: outputBlock{isFile: true, title: "a.xml", content: []byte("</file>\n<documents>")},
+			want:  "<file path=\"a.xml\">\n&lt;/file&gt;\n&lt;documents&gt;\n</file>\n",
+		},
+		{
+			name:  "escaped attributes",
+			block: outputBlock{isFile: true, title: `a"b&c.txt`, notes: []string{"<1>"}, content: []byte("x & y\n")},
+			want:  "<file path=\"a&quot;b&amp;c.txt\" notes=\"&lt;1&gt;\">\nx &amp; y\n</file>\n",
+		},
+		{
+			name:  "output with heading",
+			block: outputBlock{heading: "## <run>\n", title: "go test", content: []byte("ok\n")},
+			want:  "## &lt;run&gt;\n<output title=\"go test\">\nok\n</output>\n",
+		},
+	}
+	for _, tt := range tests {
+		if got := (xmlFormatter{}).block(tt.block); got != tt.want {
+			t.Errorf("%s: block() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestXMLFormatterJoin(t *testing.T) {
+	if got := (xmlFormatter{}).join(nil); got != "" {
+		t.Errorf("join(nil) = %q, want empty", got)
+	}
+	if got, want := (xmlFormatter{}).join([]string{"<a/>\n", "<b/>\n"}), "<documents>\n<a/>\n<b/>\n</documents>\n"; got != want {
+		t.Errorf("join() = %q, want %q", got, want)
+	}
+}
+
+func TestCodeFence(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{"", "```"},
+		{"no backticks", "```"},
+		{"inline `code`", "```"},
+		{"```go\nx\n```\n", "````"},
+		{"````md\n```go\n```\n````\n", "`````"},
+		{"a ``` b ```` c", "`````"},
+	}
+	for _, tt := range tests {
+		if got := codeFence([]byte(tt.content)); got != tt.want {
+			t.Errorf("codeFence(%q) = %q, want %q", tt.content, got, tt.want)
+		}
+	}
+}
+
+func TestOutputBlockRenderNestedFence(t *testing.T) {
+	block := outputBlock{isFile: true, lang: "markdown", title: "README.md", content: []byte("````bash\nls\n````")}
+	want := "`````markdown README.md\n````bash\nls\n````\n`````\n"
+	if got := block.render(); got != want {
+		t.Errorf("render() = %q, want %q", got, want)
+	}
+}
+
+func TestReadFileUpTo(t *testing.T) {
+	dir := t.TempDir()
+	big := strings.Repeat("x", binarySampleSize+100)
+	writeFile(t, dir, "big.txt", big)
+	writeFile(t, dir, "small.txt", "small\n")
+
+	tests := []struct {
+		path       string
+		limit      int64
+		size       int
+		contentLen int
+		sampled    bool
+	}{
+		{"small.txt", 0, 6, 6, false},
+		{"small.txt", 6, 6, 6, false},
+		{"small.txt", 5, 6, 6, true},
+		{"big.txt", 0, len(big), len(big), false},
+		{"big.txt", 10, len(big), binarySampleSize, true},
+	}
+	for _, tt := range tests {
+		file := readFileUpTo(filepath.Join(dir, tt.path), tt.limit)
+		if file.err != nil {
+			t.Fatalf("readFileUpTo(%q, %d): %v", tt.path, tt.limit, file.err)
+		}
+		if file.size != tt.size || len(file.content) != tt.contentLen || file.sampled != tt.sampled {
+			t.Errorf("readFileUpTo(%q, %d) = size %d, %d bytes read, sampled %v, want %d, %d, %v",
+				tt.path, tt.limit, file.size, len(file.content), file.sampled, tt.size, tt.contentLen, tt.sampled)
+		}
+	}
+	if file := readFileUpTo(filepath.Join(dir, "missing.txt"), 10); file.err == nil {
+		t.Error("readFileUpTo() of a missing file succeeded")
+	}
+}
+
+func TestProcessDirectoryJobs(t *testing.T) {
+	dir := t.TempDir()
+	var want []string
+	for i := range 20 {
+		path := fmt.Sprintf("f%02d.txt", i)
+		writeFile(t, dir, path, path+"\n")
+		want = append(want, path)
+	}
+	writeFile(t, dir, "zbig.txt", strings.Repeat("x", binarySampleSize+100))
+
+	var rendered []string
+	for _, jobs := range []int{1, 4} {
+		p := newTestProcessor()
+		p.jobs = jobs
+		p.maxSize = 1 << 10
+		stderr := captureStderr(t, func() { p.processDirectory(dir, ".", nil) })
+		if !slices.Equal(p.included, want) {
+			t.Errorf("with %d jobs, included = %q, want %q", jobs, p.included, want)
+		}
+		if !strings.Contains(stderr, "Skipping large file: zbig.txt (8.1 KiB, over the -max-file-size limit of 1.0 KiB)") {
+			t.Errorf("with %d jobs, zbig.txt was not skipped with its full size: %q", jobs, stderr)
+		}
+		rendered = append(rendered, p.render())
+	}
+	if rendered[0] != rendered[1] {
+		t.Errorf("the output with 4 jobs differs from the output with 1:\n%s\n%s", rendered[1], rendered[0])
+	}
+}
+
+func TestIsExcludedAnchored(t *testing.T) {
+	setIgnoreCase(t, false)
+	tests := []struct {
+		path    string
+		pattern string
+		want    bool
+	}{
+		{"dist", "/dist", true},
+		{"src/dist", "/dist", false},
+		{"src/dist", "dist", true},
+		{"dist", "/dist/", true},
+		{"src/dist", "/dist/", false},
+		{"src/dist", "dist/", true},
+		{"build/out.o", "/build/*.o", true},
+		{"lib/build/out.o", "/build/*.o", false},
+		{"lib/build/out.o", "build/*.o", false},
+	}
+	for _, tt := range tests {
+		if got, _ := isExcluded(tt.path, []string{tt.pattern}); got != tt.want {
+			t.Errorf("isExcluded(%q, %q) = %v, want %v", tt.path, tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestScopeIgnorePatterns(t *testing.T) {
+	got := scopeIgnorePatterns("web", []string{"*.log", "/dist", "build/out", "!keep.log", "cache/"})
+	want := []string{"web/**/*.log", "web/dist", "web/build/out", "!web/**/keep.log", "web/**/cache/"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("scopeIgnorePatterns() = %q, want %q", got, want)
+	}
+
+	setIgnoreCase(t, false)
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"web/a.log", true},
+		{"web/deep/a.log", true},
+		{"a.log", false},
+		{"web/keep.log", false},
+		{"web/dist", true},
+		{"web/src/dist", false},
+		{"dist", false},
+		{"web/build/out", true},
+		{"web/x/cache", true},
+	}
+	for _, tt := range tests {
+		if excluded, _ := isExcluded(tt.path, got); excluded != tt.want {
+			t.Errorf("isExcluded(%q) with the patterns of web/.gitignore = %v, want %v", tt.path, excluded, tt.want)
+		}
+	}
+}
+
+// newTestProcessor returns a processor with the maps and settings a walk needs, like main builds it.
+func newTestProcessor() *processor {
+	return &processor{
+		ctx:           context.Background(),
+		stats:         newRunStats(),
+		formatter:     markdownFormatter{delimiter: "\n"},
+		excludeVCS:    true,
+		gitDates:      make(map[string]map[string]string),
+		gitRoots:      make(map[string]string),
+		dirSizes:      make(map[string]int64),
+		markerDirs:    make(map[string]bool),
+		ownFiles:      make(map[string]bool),
+		editorConfigs: make(map[string]*editorConfigFile),
+		jobs:          1,
+	}
+}
+
+func TestProcessDirectorySymlinkLoop(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "a/f.txt", "f\n")
+	if err := os.Symlink("../a", filepath.Join(dir, "a", "self")); err != nil {
+		t.Skipf("symlinks are not supported: %v", err)
+	}
+	if err := os.Symlink("a", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		followSymlinks bool
+		want           []string
+	}{
+		{false, []string{"a/f.txt"}},
+		{true, []string{"a/f.txt"}},
+	}
+	for _, tt := range tests {
+		p := newTestProcessor()
+		p.followSymlinks = tt.followSymlinks
+		p.processDirectory(dir, ".", nil)
+		if !slices.Equal(p.included, tt.want) {
+			t.Errorf("with followSymlinks=%v, included = %q, want %q", tt.followSymlinks, p.included, tt.want)
+		}
+	}
+
+	// A link given as the target is walked at its real path, its own loop still cut
+	p := newTestProcessor()
+	p.followSymlinks = true
+	p.processDirectory(filepath.Join(dir, "link"), "link", nil)
+	if want := []string{"link/f.txt"}; !slices.Equal(p.included, want) {
+		t.Errorf("walking link, included = %q, want %q", p.included, want)
+	}
+}
+
+func TestCloneArgs(t *testing.T) {
+	const url = "https://github.com/user/repo"
+	tests := []struct {
+		name       string
+		ref        string
+		quiet      bool
+		submodules bool
+		want       []string
+	}{
+		{"default", "", false, false, []string{"clone", "--depth", "1", "--", url, "/tmp/x"}},
+		{"ref", "v1.2.0", false, false, []string{"clone", "--depth", "1", "--branch", "v1.2.0", "--", url, "/tmp/x"}},
+		{"quiet", "", true, false, []string{"clone", "--depth", "1", "--quiet", "--", url, "/tmp/x"}},
+		{"submodules", "main", true, true, []string{"clone", "--depth", "1", "--branch", "main", "--quiet", "--recurse-submodules", "--shallow-submodules", "--", url, "/tmp/x"}},
+	}
+	for _, tt := range tests {
+		if got := cloneArgs(url, "/tmp/x", tt.ref, tt.quiet, tt.submodules); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: cloneArgs() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestClipboardTools(t *testing.T) {
+	tests := []struct {
+		goos string
+		want []string
+	}{
+		{"windows", []string{"powershell", "clip"}},
+		{"darwin", []string{"pbcopy", "xclip", "xsel"}},
+		{"linux", []string{"wl-copy", "xclip", "xsel"}},
+		{"freebsd", []string{"wl-copy", "xclip", "xsel"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, tool := range clipboardTools(tt.goos) {
+			got = append(got, tool.args[0])
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("clipboardTools(%q) = %q, want %q", tt.goos, got, tt.want)
+		}
+	}
+}
+
+func TestNumberLines(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{"", ""},
+		{"one", "1 | one"},
+		{"one\n", "1 | one\n"},
+		{"a\nb\n", "1 | a\n2 | b\n"},
+		{"a\n\nc", "1 | a\n2 | \n3 | c"},
+		{strings.Repeat("x\n", 10), " 1 | x\n 2 | x\n 3 | x\n 4 | x\n 5 | x\n 6 | x\n 7 | x\n 8 | x\n 9 | x\n10 | x\n"},
+	}
+	for _, tt := range tests {
+		if got := string(numberLines([]byte(tt.content))); got != tt.want {
+			t.Errorf("numberLines(%q) = %q, want %q", tt.content, got, tt.want)
+		}
+	}
+}
+
+func TestLineNumbersEditorConfigTabWidth(t *testing.T) {
+	tests := []struct {
+		editorConfig string
+		want         string
+	}{
+		{"root = true\n[*]\ntab_width = 4\n", "1 | func main() {\n2 |     run()\n3 | }\n"},
+		{"root = true\n[*.go]\nindent_size = 2\n", "1 | func main() {\n2 |   run()\n3 | }\n"},
+		{"root = true\n[*.py]\ntab_width = 4\n", "1 | func main() {\n2 |         run()\n3 | }\n"},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		writeFile(t, dir, ".editorconfig", tt.editorConfig)
+		writeFile(t, dir, "main.go", "func main() {\n\trun()\n}\n")
+
+		p := newTestProcessor()
+		p.lineNumbers = true
+		p.processFile(filepath.Join(dir, "main.go"), "main.go")
+		if len(p.blocks) != 1 {
+			t.Fatalf("got %d blocks, want 1", len(p.blocks))
+		}
+		if got := string(p.blocks[0].content); got != tt.want {
+			t.Errorf("with .editorconfig %q, numbered content = %q, want %q", tt.editorConfig, got, tt.want)
+		}
+	}
+}
+
+func TestHiddenSkipped(t *testing.T) {
+	setIgnoreCase(t, false)
+	tests := []struct {
+		path          string
+		includeHidden bool
+		allow         []string
+		want          bool
+	}{
+		{"main.go", false, nil, false},
+		{".env", false, nil, true},
+		{".env", true, nil, false},
+		{".github", false, nil, true},
+		{".github", true, nil, false},
+		{"web/.storybook", false, nil, true},
+		{"web/.storybook", false, []string{".storybook"}, false},
+		{".env", false, []string{".storybook"}, true},
+		{".", false, nil, false},
+	}
+	for _, tt := range tests {
+		if got := hiddenSkipped(tt.path, tt.includeHidden, tt.allow); got != tt.want {
+			t.Errorf("hiddenSkipped(%q, %v, %q) = %v, want %v", tt.path, tt.includeHidden, tt.allow, got, tt.want)
+		}
+	}
+}
+
+func TestIsBinaryContent(t *testing.T) {
+	tests := []struct {
+		name    string
+		content []byte
+		want    bool
+	}{
+		{"empty", nil, false},
+		{"text", []byte("package main\n\nfunc main() {}\n"), false},
+		{"utf-8", []byte("héllo wörld, 日本語\n"), false},
+		{"tabs and form feeds", []byte("a\tb\fc\r\n"), false},
+		{"bmp-like text", []byte("BM is a fine start for a text file\n"), false},
+		{"utf-16 le", []byte{0xFF, 0xFE, 'h', 0, 'i', 0}, false},
+		{"utf-16 be", []byte{0xFE, 0xFF, 0, 'h', 0, 'i'}, false},
+		{"nul byte", []byte("text\x00more text"), true},
+		{"png", append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 16)...), true},
+		{"pdf", []byte("%PDF-1.7\nsome text after the signature\n"), true},
+		{"zip", []byte("PK\x03\x04rest of the archive"), true},
+		{"control characters", []byte("\x01\x02\x03\x04abc"), true},
+		{"invalid utf-8", []byte("\x80\x81\x82\x83ab"), true},
+		{"few control characters", []byte("plain text with one \x1b escape in a long enough line\n"), false},
+	}
+	for _, tt := range tests {
+		if got := isBinaryContent(tt.content); got != tt.want {
+			t.Errorf("%s: isBinaryContent(%q) = %v, want %v", tt.name, tt.content, got, tt.want)
+		}
+	}
+}
+
+// testConfig holds the flags defined by configFlags and the directories of the config files.
+type testConfig struct {
+	x, format   *string
+	hiddenAllow *stringList
+	userDir     string
+	projectDir  string
+}
+
+// configFlags replaces the command-line flags with a few of fcopy's, parsed from args, for the rest of the test.
+// The user config directory is moved to a temporary directory, and the working directory to another.
+func configFlags(t *testing.T, args ...string) testConfig {
+	t.Helper()
+	var c testConfig
+	saved := flag.CommandLine
+	t.Cleanup(func() { flag.CommandLine = saved })
+	flag.CommandLine = flag.NewFlagSet("fcopy", flag.ContinueOnError)
+	c.x = flag.String("x", "", "")
+	c.format = flag.String("format", "markdown", "")
+	c.hiddenAllow = &stringList{}
+	flag.Var(c.hiddenAllow, "hidden-allow", "")
+	if err := flag.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+
+	home := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", home)
+	t.Setenv("HOME", home)
+	t.Setenv("AppData", home)
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		t.Skip(err)
+	}
+	c.userDir = filepath.Join(configDir, "fcopy")
+	c.projectDir = t.TempDir()
+	t.Chdir(c.projectDir)
+	return c
+}
+
+func TestApplyConfig(t *testing.T) {
+	const user = "x = user/\nformat = xml\nhidden-allow = .github\n\n[review]\nx = review/\n"
+	const project = "x = project/\nhidden-allow = .storybook\n\n[review]\nformat = json\n"
+	tests := []struct {
+		name        string
+		args        []string
+		user        string
+		project     string
+		profile     string
+		x           string
+		format      string
+		hiddenAllow []string
+	}{
+		{"no config", nil, "", "", "", "", "markdown", nil},
+		{"user only", nil, user, "", "", "user/", "xml", []string{".github"}},
+		{"project over user", nil, user, project, "", "project/", "xml", []string{".github", ".storybook"}},
+		{"command line wins", []string{"-x", "cli/", "-format", "markdown"}, user, project, "", "cli/", "markdown", []string{".github", ".storybook"}},
+		{"profile of the project first", nil, user, project, "review", "project/", "json", []string{".github", ".storybook"}},
+		{"profile of the user", nil, user, "x = project/\n", "review", "review/", "xml", []string{".github"}},
+		{"command line over profile", []string{"-format", "xml"}, user, project, "review", "project/", "xml", []string{".github", ".storybook"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := configFlags(t, tt.args...)
+			if tt.user != "" {
+				writeFile(t, c.userDir, "config", tt.user)
+			}
+			if tt.project != "" {
+				writeFile(t, c.projectDir, configFileName, tt.project)
+			}
+			if err := applyConfig(tt.profile); err != nil {
+				t.Fatal(err)
+			}
+			if *c.x != tt.x || *c.format != tt.format || !slices.Equal(*c.hiddenAllow, tt.hiddenAllow) {
+				t.Errorf("x = %q, format = %q, hidden-allow = %q, want %q, %q, %q", *c.x, *c.format, *c.hiddenAllow, tt.x, tt.format, tt.hiddenAllow)
+			}
+		})
+	}
+}
+
+func TestApplyConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		project string
+		profile string
+		want    string
+	}{
+		{"unknown flag", "nope = 1\n", "", "unknown flag 'nope'"},
+		{"profile in a config file", "profile = review\n", "", "cannot select a profile"},
+		{"missing value", "x\n", "", "expected 'flag = value'"},
+		{"bad quoting", "x = \"unterminated\n", "", "invalid quoted value"},
+		{"missing profile", "x = a\n", "review", "profile 'review' not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := configFlags(t)
+			writeFile(t, c.projectDir, configFileName, tt.project)
+			if err := applyConfig(tt.profile); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("applyConfig() error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestFcopyIgnoreAlongsideGitignore(t *testing.T) {
+	setIgnoreCase(t, false)
+	dir := t.TempDir()
+	writeFile(t, dir, ".gitignore", "*.log\n")
+	writeFile(t, dir, ".fcopyignore", "docs/\n!keep.log\n")
+	writeFile(t, dir, "sub/.fcopyignore", "secret.txt\n")
+	for _, path := range []string{"main.go", "app.log", "keep.log", "docs/a.md", "sub/ok.txt", "sub/secret.txt"} {
+		writeFile(t, dir, path, "x\n")
+	}
+
+	tests := []struct {
+		ignoreFiles []string
+		want        []string
+	}{
+		{[]string{".gitignore", ".fcopyignore"}, []string{"keep.log", "main.go", "sub/ok.txt"}},
+		{[]string{".gitignore"}, []string{"docs/a.md", "main.go", "sub/ok.txt", "sub/secret.txt"}},
+		{[]string{".fcopyignore"}, []string{"app.log", "keep.log", "main.go", "sub/ok.txt"}},
+	}
+	for _, tt := range tests {
+		p := newTestProcessor()
+		p.ignoreFiles = tt.ignoreFiles
+		// Like main, the ignore files of the target itself are read before the walk
+		var excludes []string
+		for _, ignoreFile := range tt.ignoreFiles {
+			excludes = append(excludes, readIgnoreFile(dir, ignoreFile)...)
+		}
+		p.processDirectory(dir, ".", excludes)
+		if !slices.Equal(p.included, tt.want) {
+			t.Errorf("with %q, included = %q, want %q", tt.ignoreFiles, p.included, tt.want)
+		}
+	}
+}
+
+func TestRenderJSON(t *testing.T) {
+	blocks := []outputBlock{
+		{isFile: true, lang: "go", title: "main.go", content: []byte("package main\n\nfunc main() {}\n")},
+		{isFile: true, title: "notes.txt", content: []byte("<b> & \"quotes\"\n")},
+		{isFile: true, lang: "text", title: "empty.txt"},
+	}
+	want := []jsonFile{
+		{Path: "main.go", Language: "go", Bytes: 29, TokenEstimate: 7, Content: "package main\n\nfunc main() {}\n"},
+		{Path: "notes.txt", Bytes: len("<b> & \"quotes\"\n"), TokenEstimate: countTokens("<b> & \"quotes\"\n"), Content: "<b> & \"quotes\"\n"},
+		{Path: "empty.txt", Language: "text", Bytes: 0, TokenEstimate: 0, Content: ""},
+	}
+
+	rendered, err := renderJSON(blocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(rendered, `"<b> & \"quotes\"\n"`) {
+		t.Errorf("renderJSON() escaped HTML characters: %s", rendered)
+	}
+	var got []jsonFile
+	if err := json.Unmarshal([]byte(rendered), &got); err != nil {
+		t.Fatalf("renderJSON() is not valid JSON: %v\n%s", err, rendered)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("renderJSON() = %+v, want %+v", got, want)
+	}
+	for _, field := range []string{`"path"`, `"language"`, `"bytes"`, `"tokenEstimate"`, `"content"`} {
+		if !strings.Contains(rendered, field) {
+			t.Errorf("renderJSON() has no %s field: %s", field, rendered)
+		}
+	}
+}
+
+func TestRenderJSONTokenizer(t *testing.T) {
+	ranks, err := parseRanks(strings.NewReader("YQ== 0\nYg== 1\nYWI= 2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := tokenizer
+	tokenizer = &bpeEncoder{name: "test", ranks: ranks}
+	t.Cleanup(func() { tokenizer = saved })
+
+	rendered, err := renderJSON([]outputBlock{{isFile: true, title: "ab.txt", content: []byte("abab")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []jsonFile
+	if err := json.Unmarshal([]byte(rendered), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].TokenEstimate != 2 || got[0].Bytes != 4 {
+		t.Errorf("renderJSON() with a tokenizer = %+v, want 4 bytes and 2 tokens", got)
+	}
+}
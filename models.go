@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// modelInfo describes a model for the estimates derived from the token count.
+type modelInfo struct {
+	// inputPerMTok is the price in USD per million input tokens.
+	inputPerMTok float64
+	// contextWindow is the number of tokens the model accepts in a single request.
+	contextWindow int
+}
+
+// knownModels holds approximate public list prices and context windows, good enough for planning a paste.
+// Prices change: -cost-per-mtok overrides them, or prices a model missing from the table.
+var knownModels = map[string]modelInfo{
+	"gpt-4o":           {inputPerMTok: 2.50, contextWindow: 128_000},
+	"gpt-4o-mini":      {inputPerMTok: 0.15, contextWindow: 128_000},
+	"gpt-4.1":          {inputPerMTok: 2.00, contextWindow: 1_047_576},
+	"gpt-4.1-mini":     {inputPerMTok: 0.40, contextWindow: 1_047_576},
+	"o3":               {inputPerMTok: 2.00, contextWindow: 200_000},
+	"claude-opus-4":    {inputPerMTok: 15.00, contextWindow: 200_000},
+	"claude-sonnet-4":  {inputPerMTok: 3.00, contextWindow: 200_000},
+	"claude-haiku-3.5": {inputPerMTok: 0.80, contextWindow: 200_000},
+	"gemini-2.5-pro":   {inputPerMTok: 1.25, contextWindow: 1_048_576},
+	"gemini-2.5-flash": {inputPerMTok: 0.30, contextWindow: 1_048_576},
+}
+
+// resolveModelPrice returns the input price per million tokens for model, preferring override when it is positive.
+func resolveModelPrice(model string, override float64) (float64, error) {
+	if override > 0 {
+		return override, nil
+	}
+	info, ok := knownModels[model]
+	if !ok {
+		return 0, fmt.Errorf("unknown model '%s' (use -cost-per-mtok to price it)", model)
+	}
+	return info.inputPerMTok, nil
+}
+
+// resolveContextWindow returns the context window of model, in tokens.
+func resolveContextWindow(model string) (int, error) {
+	info, ok := knownModels[model]
+	if !ok {
+		return 0, fmt.Errorf("unknown model '%s' (see -list-models)", model)
+	}
+	return info.contextWindow, nil
+}
+
+// checkContextWindow warns on stderr when the estimated token count does not fit the context window of model,
+// with how much has to be trimmed; otherwise it reports the share of the window used.
+func checkContextWindow(w io.Writer, model string, window int, tokens int) {
+	if tokens > window {
+		over := tokens - window
+		fmt.Fprintf(w, "\n*** WARNING: ~%d tokens exceeds the %d-token context window of %s. Trim at least ~%d tokens (%.0f%%). ***\n\n",
+			tokens, window, model, over, float64(over)*100/float64(tokens))
+		return
+	}
+	fmt.Fprintf(w, "Fits the context window of %s: %.0f%% of %d tokens used.\n", model, float64(tokens)*100/float64(window), window)
+}
+
+// printModels writes the built-in model table sorted by name.
+func printModels(w io.Writer) {
+	names := make([]string, 0, len(knownModels))
+	width := 0
+	for name := range knownModels {
+		names = append(names, name)
+		width = max(width, len(name))
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		info := knownModels[name]
+		fmt.Fprintf(w, "%-*s  $%5.2f / 1M input tokens  %9d tokens context\n", width, name, info.inputPerMTok, info.contextWindow)
+	}
+}
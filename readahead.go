@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// fileContent is a file read for processing. A file over the size limit of its read is not read whole:
+// content is then only its first binarySampleSize bytes, enough for the checks that skip it.
+type fileContent struct {
+	content []byte
+	size    int
+	sampled bool
+	err     error
+}
+
+// readFile reads the whole file at path.
+func readFile(path string) fileContent {
+	content, err := os.ReadFile(path)
+	return fileContent{content: content, size: len(content), err: err}
+}
+
+// readFileUpTo reads the file at path, or only a sample of its start when it is larger than limit (0 for no limit).
+func readFileUpTo(path string, limit int64) fileContent {
+	if limit <= 0 {
+		return readFile(path)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return fileContent{err: err}
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return fileContent{err: err}
+	}
+	if info.Size() <= limit {
+		content, err := io.ReadAll(file)
+		return fileContent{content: content, size: len(content), err: err}
+	}
+	sample, err := readSample(file)
+	return fileContent{content: sample, size: int(info.Size()), sampled: true, err: err}
+}
+
+// readAhead reads files with a pool of workers while they are processed one by one in walk order,
+// so slow disks and network mounts serve several reads at once without changing the output.
+// At most twice as many files as workers are held in memory ahead of the one being processed, and files
+// over the size limit are not read whole.
+type readAhead struct {
+	results []chan fileContent
+	window  chan struct{}
+	done    chan struct{}
+}
+
+// startReadAhead starts reading paths with jobs workers, sampling the files larger than limit as readFileUpTo
+// does. Every content must be taken with next, in order, or the reading ended with stop.
+func startReadAhead(paths []string, jobs int, limit int64) *readAhead {
+	r := &readAhead{
+		results: make([]chan fileContent, len(paths)),
+		window:  make(chan struct{}, 2*jobs),
+		done:    make(chan struct{}),
+	}
+	for i := range r.results {
+		r.results[i] = make(chan fileContent, 1)
+	}
+
+	tasks := make(chan int)
+	go func() {
+		defer close(tasks)
+		for i := range paths {
+			select {
+			case r.window <- struct{}{}:
+			case <-r.done:
+				return
+			}
+			select {
+			case tasks <- i:
+			case <-r.done:
+				return
+			}
+		}
+	}()
+	for range jobs {
+		go func() {
+			for i := range tasks {
+				r.results[i] <- readFileUpTo(paths[i], limit)
+			}
+		}()
+	}
+	return r
+}
+
+// next waits for the content of the i-th path, freeing its place in the window for another read.
+func (r *readAhead) next(i int) fileContent {
+	result := <-r.results[i]
+	<-r.window
+	return result
+}
+
+// stop stops starting new reads, for when the remaining files are not needed.
+func (r *readAhead) stop() {
+	close(r.done)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"regexp"
+	"strings"
+)
+
+// symbolPatterns are line-based heuristics listing the top-level declarations of languages without a parser.
+// Each pattern matches a whole declaration line; the line is trimmed of its body opener and kept as the signature.
+var symbolPatterns = map[string]*regexp.Regexp{
+	"python":     regexp.MustCompile(`^(\s*)(async\s+def|def|class)\s+\w+.*`),
+	"javascript": regexp.MustCompile(`^(export\s+)?(default\s+)?(async\s+)?(function\*?|class)\s+\w+.*|^(export\s+)?(const|let)\s+\w+\s*=\s*(async\s+)?(\(|function).*`),
+	"typescript": regexp.MustCompile(`^(export\s+)?(default\s+)?(abstract\s+)?(async\s+)?(function\*?|class|interface|type|enum)\s+\w+.*|^(export\s+)?(const|let)\s+\w+\s*=\s*(async\s+)?(\(|function).*`),
+	"rust":       regexp.MustCompile(`^\s*(pub(\([^)]*\))?\s+)?(async\s+)?(fn|struct|enum|trait|impl|mod|type)\b.*`),
+	"java":       regexp.MustCompile(`^\s*(public|protected|private)\s+.*(class|interface|enum|record|\))\s*.*`),
+	"kotlin":     regexp.MustCompile(`^\s*((public|private|internal|protected|open|abstract|data|sealed|suspend)\s+)*(fun|class|interface|object)\s+.*`),
+	"ruby":       regexp.MustCompile(`^\s*(def|class|module)\s+.*`),
+	"c":          regexp.MustCompile(`^[A-Za-z_][\w\s\*]*\s\**\w+\s*\([^;]*$|^(typedef\s+)?(struct|enum|union)\s+\w+.*`),
+	"cpp":        regexp.MustCompile(`^[A-Za-z_][\w\s\*:<>,&]*\s[\*&]*[\w:~]+\s*\([^;]*$|^(class|struct|enum|namespace)\s+\w+.*`),
+}
+
+// repoMapSymbols lists the top-level declaration signatures of a file, for -repo-map.
+// Go is parsed properly; other languages use symbolPatterns. It reports false when the language
+// is not supported or the file could not be parsed, in which case only the file name is mapped.
+func repoMapSymbols(lang string, content []byte) ([]string, bool) {
+	if lang == "go" {
+		return goSymbols(content)
+	}
+	pattern, ok := symbolPatterns[lang]
+	if !ok {
+		return nil, false
+	}
+
+	var symbols []string
+	for _, line := range strings.Split(string(content), "\n") {
+		if !pattern.MatchString(line) {
+			continue
+		}
+		line = strings.TrimRight(line, " \t\r")
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "{"), ":")
+		symbols = append(symbols, strings.TrimRight(line, " \t"))
+	}
+	return symbols, true
+}
+
+// goSymbols lists the function signatures, types, constants and variables declared at the top level of Go source.
+func goSymbols(src []byte) ([]string, bool) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "", src, 0)
+	if err != nil {
+		return nil, false
+	}
+
+	var symbols []string
+	for _, decl := range file.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			decl.Body = nil
+			var buf bytes.Buffer
+			if err := printer.Fprint(&buf, fset, decl); err == nil {
+				symbols = append(symbols, buf.String())
+			}
+		case *ast.GenDecl:
+			for _, spec := range decl.Specs {
+				switch spec := spec.(type) {
+				case *ast.TypeSpec:
+					symbols = append(symbols, "type "+spec.Name.Name+" "+goTypeKind(spec.Type))
+				case *ast.ValueSpec:
+					var names []string
+					for _, name := range spec.Names {
+						names = append(names, name.Name)
+					}
+					symbols = append(symbols, decl.Tok.String()+" "+strings.Join(names, ", "))
+				}
+			}
+		}
+	}
+	return symbols, true
+}
+
+// goTypeKind summarizes a type definition as struct, interface, func, or the underlying type name.
+func goTypeKind(expr ast.Expr) string {
+	switch expr := expr.(type) {
+	case *ast.StructType:
+		return "struct"
+	case *ast.InterfaceType:
+		return "interface"
+	case *ast.FuncType:
+		return "func"
+	case *ast.Ident:
+		return expr.Name
+	}
+	return "..."
+}
+
+// repoMapEntry is a file listed by -repo-map with the signatures found in it.
+type repoMapEntry struct {
+	path    string
+	symbols []string
+}
+
+// renderRepoMap formats the mapped files as an indented listing, one file per line followed by its symbols.
+func renderRepoMap(entries []repoMapEntry) string {
+	var sb strings.Builder
+	for _, entry := range entries {
+		sb.WriteString(entry.path + "\n")
+		for _, symbol := range entry.symbols {
+			// Multi-line signatures are kept on one line to keep the map compact, while the
+			// leading indentation shows nesting such as methods inside a class
+			indent := symbol[:len(symbol)-len(strings.TrimLeft(symbol, " \t"))]
+			sb.WriteString("  " + indent + strings.Join(strings.Fields(symbol), " ") + "\n")
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Skip reasons recorded in runStats.
+const (
+	skipExcluded        = "excluded"
+	skipHidden          = "hidden"
+	skipBinary          = "binary"
+	skipTooLarge        = "too-large"
+	skipLongLines       = "long-lines"
+	skipExcludedContent = "excluded-content"
+	skipLockFile        = "lock-file"
+	skipDirTooLarge     = "dir-too-large"
+	skipOnlyDirsWith    = "only-dirs-with"
+	skipMaxMatches      = "max-matches"
+	skipTests           = "test-file"
+	skipNotTests        = "not-test-file"
+	skipCommentsOnly    = "comments-only"
+	skipFilterFailed    = "filter-failed"
+	skipNotIncluded     = "not-included"
+	skipSymlinkEscape   = "symlink-escape"
+)
+
+// runStats tallies what happened during a run, for the end-of-run summaries.
+type runStats struct {
+	start         time.Time
+	included      int
+	includedBytes int
+	errors        int
+	skipped       map[string][]string // reason -> display paths, in walk order
+}
+
+func newRunStats() *runStats {
+	return &runStats{start: time.Now(), skipped: make(map[string][]string)}
+}
+
+// skip records that path was left out of the output for reason.
+func (s *runStats) skip(reason string, path string) {
+	s.skipped[reason] = append(s.skipped[reason], path)
+}
+
+// runSummary is the machine-readable report written by -summary-json.
+type runSummary struct {
+	FilesIncluded   int            `json:"filesIncluded"`
+	FilesSkipped    map[string]int `json:"filesSkipped"`
+	Errors          int            `json:"errors"`
+	IncludedBytes   int            `json:"includedBytes"`
+	OutputBytes     int            `json:"outputBytes"`
+	EstimatedTokens int            `json:"estimatedTokens"`
+	EstimatedCost   float64        `json:"estimatedCostUsd,omitempty"`
+	ChunkTokens     []int          `json:"chunkTokens,omitempty"`
+	Backend         string         `json:"backend"`
+	DurationMs      int64          `json:"durationMs"`
+}
+
+// writeSummaryJSON writes the run summary as a single JSON object to path, or to stderr when path is "-".
+func writeSummaryJSON(path string, stats *runStats, outputBytes int, tokens int, cost float64, chunks []int, backend string) error {
+	summary := runSummary{
+		FilesIncluded:   stats.included,
+		FilesSkipped:    make(map[string]int, len(stats.skipped)),
+		Errors:          stats.errors,
+		IncludedBytes:   stats.includedBytes,
+		OutputBytes:     outputBytes,
+		EstimatedTokens: tokens,
+		EstimatedCost:   cost,
+		ChunkTokens:     chunks,
+		Backend:         backend,
+		DurationMs:      time.Since(stats.start).Milliseconds(),
+	}
+	for reason, paths := range stats.skipped {
+		summary.FilesSkipped[reason] = len(paths)
+	}
+
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	if path == "-" {
+		_, err = fmt.Fprintln(os.Stderr, string(data))
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// skipSummaryPaths is how many paths printSkipSummary lists for each reason.
+const skipSummaryPaths = 5
+
+// printSkipSummary writes the paths left out of the output grouped by reason, with their count and the first
+// skipSummaryPaths of each, so the skips logged during the walk can be reviewed at the end. Paths are printed
+// through display, like the file headers. It writes nothing when no path was skipped.
+func printSkipSummary(w io.Writer, stats *runStats, display func(string) string) {
+	total := 0
+	for _, paths := range stats.skipped {
+		total += len(paths)
+	}
+	if total == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "Skipped %d path(s):\n", total)
+	for _, reason := range slices.Sorted(maps.Keys(stats.skipped)) {
+		paths := stats.skipped[reason]
+		shown := make([]string, min(len(paths), skipSummaryPaths))
+		for i := range shown {
+			shown[i] = display(paths[i])
+		}
+		listed := strings.Join(shown, ", ")
+		if len(paths) > skipSummaryPaths {
+			listed += fmt.Sprintf(", and %d more", len(paths)-skipSummaryPaths)
+		}
+		fmt.Fprintf(w, "  %-16s %4d  %s\n", reason, len(paths), listed)
+	}
+}
+
+// dryRunEntry is a file -dry-run found would be included.
+type dryRunEntry struct {
+	path string
+	size int
+	lang string
+}
+
+// printDryRun writes the files -dry-run found, with their size and language, then their count and total size
+// and the number of paths skipped for each reason. Paths are printed through display, like the file headers.
+func printDryRun(w io.Writer, entries []dryRunEntry, stats *runStats, display func(string) string) {
+	total := 0
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%10s  %-12s  %s\n", formatSize(entry.size), cmp.Or(entry.lang, "-"), display(entry.path))
+		total += entry.size
+	}
+	fmt.Fprintf(w, "%d file(s), %s\n", len(entries), formatSize(total))
+	for _, reason := range slices.Sorted(maps.Keys(stats.skipped)) {
+		fmt.Fprintf(w, "skipped (%s): %d\n", reason, len(stats.skipped[reason]))
+	}
+}
+
+// printTokenReport writes the topN file blocks with the most tokens, then the remaining files and
+// the text around them (headers, fences, prompt), so the lines add up to the total token count.
+func printTokenReport(w io.Writer, blocks []outputBlock, total int, topN int) {
+	type fileTokens struct {
+		path   string
+		tokens int
+	}
+	var files []fileTokens
+	for _, block := range blocks {
+		if block.isFile {
+			files = append(files, fileTokens{path: block.title, tokens: countTokens(string(block.content))})
+		}
+	}
+	slices.SortStableFunc(files, func(a, b fileTokens) int { return cmp.Compare(b.tokens, a.tokens) })
+
+	shown := min(topN, len(files))
+	fmt.Fprintf(w, "Token report (top %d of %d files):\n", shown, len(files))
+	remaining := total
+	for _, file := range files[:shown] {
+		fmt.Fprintf(w, "  %8d  %s\n", file.tokens, file.path)
+		remaining -= file.tokens
+	}
+	if rest := files[shown:]; len(rest) > 0 {
+		restTokens := 0
+		for _, file := range rest {
+			restTokens += file.tokens
+		}
+		fmt.Fprintf(w, "  %8d  %d other file(s)\n", restTokens, len(rest))
+		remaining -= restTokens
+	}
+	fmt.Fprintf(w, "  %8d  headers, prompt and other text\n", remaining)
+	fmt.Fprintf(w, "  %8d  total\n", total)
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// cl100kURL is where tiktoken publishes the cl100k_base ranks. They are downloaded on the first use
+// of -tokenizer cl100k and cached as cl100kFileName in the fcopy user cache directory, and checked
+// against cl100kSHA256, the hash tiktoken publishes for them, before every use.
+const (
+	cl100kURL      = "https://openaipublic.blob.core.windows.net/encodings/cl100k_base.tiktoken"
+	cl100kFileName = "cl100k_base.tiktoken"
+	cl100kSHA256   = "223921b76ee99bde995b7ff738513eef100fb51d18c93597a113bcffe865b2a7"
+)
+
+// tokenizer counts tokens exactly when -tokenizer selects an encoding; otherwise countTokens estimates them.
+var tokenizer *bpeEncoder
+
+// countTokens returns the token count of content with the selected tokenizer, or the estimateTokens heuristic.
+func countTokens(content string) int {
+	if tokenizer != nil {
+		return tokenizer.count(content)
+	}
+	tokens, _ := estimateTokens(content)
+	return tokens
+}
+
+// bpeEncoder is a byte pair encoder with tiktoken ranks, used for counting only.
+type bpeEncoder struct {
+	name  string
+	ranks map[string]int
+}
+
+// loadCl100k returns the cl100k_base encoder, downloading its ranks to the cache directory when missing.
+func loadCl100k(ctx context.Context) (*bpeEncoder, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(cacheDir, "fcopy", cl100kFileName)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "Downloading the cl100k_base tokenizer ranks to %s...\n", path)
+		if err := downloadFile(ctx, cl100kURL, path); err != nil {
+			return nil, fmt.Errorf("downloading %s: %w", cl100kURL, err)
+		}
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// A corrupted or tampered file is removed, so the next run downloads it again
+	if sum := sha256.Sum256(content); hex.EncodeToString(sum[:]) != cl100kSHA256 {
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("%s: sha256 mismatch, and removing it failed: %w", path, err)
+		}
+		return nil, fmt.Errorf("%s: sha256 mismatch, expected %s; the file was removed and is downloaded again on the next run", path, cl100kSHA256)
+	}
+	ranks, err := parseRanks(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &bpeEncoder{name: "cl100k_base", ranks: ranks}, nil
+}
+
+// downloadFile writes the body of url to path, through a temporary file so an interrupted download leaves nothing behind.
+func downloadFile(ctx context.Context, url string, path string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, resp.Body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// parseRanks reads a tiktoken ranks file: one base64 encoded token and its rank per line.
+func parseRanks(r io.Reader) (map[string]int, error) {
+	ranks := make(map[string]int)
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		encoded, rankText, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected 'token rank'", lineNumber)
+		}
+		token, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+		rank, err := strconv.Atoi(rankText)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+		ranks[string(token)] = rank
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(ranks) == 0 {
+		return nil, fmt.Errorf("no ranks found")
+	}
+	return ranks, nil
+}
+
+// count returns the number of tokens of text: the sum of the byte pair encodings of its pieces.
+func (e *bpeEncoder) count(text string) int {
+	tokens := 0
+	for _, piece := range cl100kPieces(text) {
+		tokens += e.countPiece(piece)
+	}
+	return tokens
+}
+
+// countPiece byte pair encodes a piece, repeatedly merging the adjacent parts with the lowest rank.
+func (e *bpeEncoder) countPiece(piece string) int {
+	if _, ok := e.ranks[piece]; ok {
+		return 1
+	}
+	// bounds[i] is the start of the i-th part; the last bound is the end of the piece
+	bounds := make([]int, len(piece)+1)
+	for i := range bounds {
+		bounds[i] = i
+	}
+	for len(bounds) > 2 {
+		best, bestRank := -1, 0
+		for i := 0; i+2 < len(bounds); i++ {
+			if rank, ok := e.ranks[piece[bounds[i]:bounds[i+2]]]; ok && (best < 0 || rank < bestRank) {
+				best, bestRank = i, rank
+			}
+		}
+		if best < 0 {
+			break
+		}
+		bounds = append(bounds[:best+1], bounds[best+2:]...)
+	}
+	return len(bounds) - 1
+}
+
+// cl100kContractions are matched first by the cl100k_base split pattern, case-insensitively.
+var cl100kContractions = []string{"s", "t", "re", "ve", "m", "ll", "d"}
+
+// cl100kPieces splits text like the cl100k_base pattern, which Go's regexp cannot express as it uses a lookahead:
+//
+//	(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+(?!\S)|\s+
+//
+// The alternatives are tried in order at each position, like the regular expression does.
+func cl100kPieces(text string) []string {
+	runes := []rune(text)
+	isNewline := func(r rune) bool { return r == '\r' || r == '\n' }
+	isOther := func(r rune) bool { return !unicode.IsSpace(r) && !unicode.IsLetter(r) && !unicode.IsNumber(r) }
+
+	var pieces []string
+	for i := 0; i < len(runes); {
+		end := cl100kPieceEnd(runes, i, isNewline, isOther)
+		pieces = append(pieces, string(runes[i:end]))
+		i = end
+	}
+	return pieces
+}
+
+// cl100kPieceEnd returns the end of the piece starting at i.
+func cl100kPieceEnd(runes []rune, i int, isNewline func(rune) bool, isOther func(rune) bool) int {
+	n := len(runes)
+	r := runes[i]
+
+	// 's, 't, 're, 've, 'm, 'll, 'd
+	if r == '\'' {
+		for _, suffix := range cl100kContractions {
+			end := i + 1 + len(suffix)
+			if end <= n && strings.EqualFold(string(runes[i+1:end]), suffix) {
+				return end
+			}
+		}
+	}
+
+	// [^\r\n\p{L}\p{N}]?\p{L}+
+	start := i
+	if !isNewline(r) && !unicode.IsLetter(r) && !unicode.IsNumber(r) && i+1 < n && unicode.IsLetter(runes[i+1]) {
+		start = i + 1
+	}
+	if unicode.IsLetter(runes[start]) {
+		end := start
+		for end < n && unicode.IsLetter(runes[end]) {
+			end++
+		}
+		return end
+	}
+
+	// \p{N}{1,3}
+	if unicode.IsNumber(r) {
+		end := i
+		for end < n && end < i+3 && unicode.IsNumber(runes[end]) {
+			end++
+		}
+		return end
+	}
+
+	// ' ?[^\s\p{L}\p{N}]+[\r\n]*'
+	start = i
+	if r == ' ' && i+1 < n && isOther(runes[i+1]) {
+		start = i + 1
+	}
+	if isOther(runes[start]) {
+		end := start
+		for end < n && isOther(runes[end]) {
+			end++
+		}
+		for end < n && isNewline(runes[end]) {
+			end++
+		}
+		return end
+	}
+
+	// The whitespace alternatives, over the run of whitespace starting at i
+	run := i
+	for run < n && unicode.IsSpace(runes[run]) {
+		run++
+	}
+	// \s*[\r\n]+ backtracks to end right after the last newline of the run
+	for j := run - 1; j >= i; j-- {
+		if isNewline(runes[j]) {
+			return j + 1
+		}
+	}
+	// \s+(?!\S) leaves the last space of a run followed by text to the next piece
+	if run < n && run-i > 1 {
+		return run - 1
+	}
+	// \s+
+	return max(run, i+1)
+}
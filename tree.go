@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// treeNode is a directory or file in a rendered path tree.
+type treeNode struct {
+	name     string
+	children map[string]*treeNode
+}
+
+// renderTree draws slash separated relative paths as an indented tree in the style of the `tree` command,
+// with root as the first line. Directories are listed before files, each group sorted by name.
+func renderTree(root string, paths []string) string {
+	top := &treeNode{name: root, children: map[string]*treeNode{}}
+	for _, path := range paths {
+		node := top
+		for _, part := range strings.Split(path, "/") {
+			if part == "" || part == "." {
+				continue
+			}
+			child, ok := node.children[part]
+			if !ok {
+				child = &treeNode{name: part, children: map[string]*treeNode{}}
+				node.children[part] = child
+			}
+			node = child
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(root)
+	sb.WriteByte('\n')
+	writeTreeChildren(&sb, top, "")
+	return sb.String()
+}
+
+// writeTreeChildren writes the children of node, using prefix for the connector lines of parent levels.
+func writeTreeChildren(sb *strings.Builder, node *treeNode, prefix string) {
+	names := make([]string, 0, len(node.children))
+	for name := range node.children {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := node.children[names[i]], node.children[names[j]]
+		aDir, bDir := len(a.children) > 0, len(b.children) > 0
+		if aDir != bDir {
+			return aDir
+		}
+		return names[i] < names[j]
+	})
+
+	for i, name := range names {
+		child := node.children[name]
+		connector, childPrefix := "├── ", "│   "
+		if i == len(names)-1 {
+			connector, childPrefix = "└── ", "    "
+		}
+		sb.WriteString(prefix + connector + name)
+		if len(child.children) > 0 {
+			sb.WriteByte('/')
+		}
+		sb.WriteByte('\n')
+		writeTreeChildren(sb, child, prefix+childPrefix)
+	}
+}
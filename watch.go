@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce is how long -watch waits for further changes before refreshing,
+// so saving several files at once triggers a single run.
+const watchDebounce = 300 * time.Millisecond
+
+// watchFlag matches the -watch flag in its accepted forms, dropped from the arguments of each refresh run.
+var watchFlag = regexp.MustCompile(`^--?watch(=.*)?$`)
+
+// watchRoot is a path argument observed by -watch, with the exclude patterns that apply below it.
+type watchRoot struct {
+	absPath  string
+	isDir    bool
+	excludes []string
+}
+
+// watcher re-runs fcopy whenever a file that the run would consider changes.
+type watcher struct {
+	fs       *fsnotify.Watcher
+	roots    []watchRoot
+	unignore []string
+	ignored  map[string]bool // fcopy's own outputs, which must not trigger a refresh
+
+	includeHidden bool
+	hiddenAllow   []string
+}
+
+// watchAndRerun runs fcopy once without -watch, then again after every relevant change below roots, until interrupted.
+// Changes to hidden, VCS and excluded paths, and to the ignored files, are not relevant.
+func watchAndRerun(roots []watchRoot, unignore []string, ignored map[string]bool, includeHidden bool, hiddenAllow []string) {
+	fsWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		fatalf("Error starting file watcher: %v", err)
+	}
+	defer fsWatcher.Close()
+
+	w := &watcher{
+		fs:            fsWatcher,
+		roots:         roots,
+		unignore:      unignore,
+		ignored:       ignored,
+		includeHidden: includeHidden,
+		hiddenAllow:   hiddenAllow,
+	}
+	for _, root := range roots {
+		if root.isDir {
+			w.addTree(root, root.absPath)
+		} else if err := fsWatcher.Add(filepath.Dir(root.absPath)); err != nil {
+			fatalf("Error watching %s: %v", root.absPath, err)
+		}
+	}
+
+	// -watch=false is passed explicitly, so a watch setting of a config file cannot make the runs watch too
+	args := []string{"-watch=false"}
+	for _, arg := range os.Args[1:] {
+		if !watchFlag.MatchString(arg) {
+			args = append(args, arg)
+		}
+	}
+	w.rerun(args)
+	fmt.Fprintln(os.Stderr, "Watching for changes, press Ctrl-C to stop.")
+
+	var refresh <-chan time.Time
+	changed := ""
+	for {
+		select {
+		case event, ok := <-fsWatcher.Events:
+			if !ok {
+				return
+			}
+			root, ok := w.relevant(event.Name)
+			if !ok {
+				continue
+			}
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					w.addTree(root, event.Name)
+				}
+			}
+			changed = event.Name
+			refresh = time.After(watchDebounce)
+		case <-refresh:
+			refresh = nil
+			fmt.Fprintf(os.Stderr, "\n[%s] %s changed, refreshing...\n", time.Now().Format("15:04:05"), changed)
+			w.rerun(args)
+		case err, ok := <-fsWatcher.Errors:
+			if !ok {
+				return
+			}
+			fmt.Fprintf(os.Stderr, "Watch error: %v\n", err)
+		}
+	}
+}
+
+// rerun executes fcopy with args, streaming its output; a failed run is reported and watching continues.
+func (w *watcher) rerun(args []string) {
+	self, err := os.Executable()
+	if err != nil {
+		fatalf("Error locating the fcopy executable: %v", err)
+	}
+	cmd := exec.Command(self, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "Refresh failed: %v\n", err)
+	}
+}
+
+// addTree watches dir and every subdirectory the walk would descend into.
+func (w *watcher) addTree(root watchRoot, dir string) {
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		if path != root.absPath && !w.inRoot(root, path) {
+			return filepath.SkipDir
+		}
+		if err := w.fs.Add(path); err != nil {
+			fmt.Fprintf(os.Stderr, "Watch error: cannot watch %s: %v\n", path, err)
+		}
+		return nil
+	})
+}
+
+// relevant returns the root a changed path belongs to, if the path is one fcopy would consider.
+func (w *watcher) relevant(path string) (watchRoot, bool) {
+	if w.ignored[path] {
+		return watchRoot{}, false
+	}
+	for _, root := range w.roots {
+		if !root.isDir {
+			if path == root.absPath {
+				return root, true
+			}
+			continue
+		}
+		if w.inRoot(root, path) {
+			return root, true
+		}
+	}
+	return watchRoot{}, false
+}
+
+// inRoot reports whether path lies below a directory root without crossing a hidden, VCS or excluded path.
+func (w *watcher) inRoot(root watchRoot, path string) bool {
+	rel, err := filepath.Rel(root.absPath, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return false
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	kept := false // below an -unignore match, exclude patterns no longer apply
+	for i, part := range parts {
+		partial := strings.Join(parts[:i+1], "/")
+		if vcsDirNames[part] || hiddenSkipped(partial, w.includeHidden, w.hiddenAllow) {
+			return false
+		}
+		if !kept {
+			kept, _ = isExcluded(partial, w.unignore)
+		}
+		if excluded, _ := isExcluded(partial, root.excludes); excluded && !kept {
+			return false
+		}
+	}
+	return true
+}